@@ -1,17 +1,26 @@
 package main
 
 import (
+    "context"
     "net/http"
     "os"
+    "os/signal"
+    "strconv"
+    "syscall"
+    "time"
 
     "github.com/gorilla/mux"
     "github.com/sirupsen/logrus"
 
     "csv-email-flagger/internal/api"
+    "csv-email-flagger/internal/jobs"
     "csv-email-flagger/internal/storage"
     "csv-email-flagger/pkg/logger"
 )
 
+// shutdownTimeout bounds how long a shutdown waits for requests in flight
+const shutdownTimeout = 30 * time.Second
+
 func main() {
     logger.Init()
     log := logger.Log
@@ -20,6 +29,33 @@ func main() {
         log.WithError(err).Fatal("failed to ensure storage")
     }
 
+    // Webhook settings are read once; callbacks are refused without a secret
+    jobs.WebhookSecret = []byte(os.Getenv("WEBHOOK_SECRET"))
+    jobs.AllowPrivateCallbacks, _ = strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_PRIVATE"))
+    if len(jobs.WebhookSecret) == 0 {
+        log.Warn("WEBHOOK_SECRET is not set, uploads with a callback_url will be refused")
+    }
+
+    // JOB_STORE=memory keeps jobs in memory only
+    var store *jobs.FileStore
+    if path := os.Getenv("JOB_STORE"); path != "memory" {
+        if path == "" {
+            path = storage.GetJobLogPath()
+        }
+        var err error
+        store, err = jobs.OpenFileStore(path, jobs.Events)
+        if err != nil {
+            log.WithError(err).Fatal("failed to open job store")
+        }
+        jobs.Jobs = store
+        if n := jobs.ResumeInterrupted(); n > 0 {
+            log.WithField("jobs", n).Info("resuming interrupted jobs")
+        }
+        if n := jobs.ResumeWebhooks(); n > 0 {
+            log.WithField("webhooks", n).Info("resuming webhook deliveries")
+        }
+    }
+
     r := mux.NewRouter()
     api.RegisterRoutes(r)
 
@@ -29,11 +65,43 @@ func main() {
     }
 
     log.WithFields(logrus.Fields{
-        "port": port,
-        "mode": os.Getenv("PROCESS_MODE"),
+        "port":        port,
+        "mode":        os.Getenv("PROCESS_MODE"),
+        "workers":     os.Getenv("WORKERS"),
+        "max_workers": os.Getenv("MAX_WORKERS"),
     }).Info("server starting")
 
-    if err := http.ListenAndServe(":"+port, r); err != nil {
-        log.WithError(err).Fatal("server stopped unexpectedly")
+    srv := &http.Server{Addr: ":" + port, Handler: r}
+    serveErr := make(chan error, 1)
+    go func() {
+        serveErr <- srv.ListenAndServe()
+    }()
+
+    // SIGINT and SIGTERM stop the server once the requests in flight are done,
+    // then the job log is closed. Running jobs resume on the next start.
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    failed := false
+    select {
+    case err := <-serveErr:
+        log.WithError(err).Error("server stopped unexpectedly")
+        failed = true
+    case <-ctx.Done():
+        log.Info("shutting down")
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+        if err := srv.Shutdown(shutdownCtx); err != nil {
+            log.WithError(err).Warn("requests still in flight at shutdown")
+        }
+        cancel()
+    }
+
+    if store != nil {
+        if err := store.Close(); err != nil {
+            log.WithError(err).Error("failed to close job store")
+            failed = true
+        }
+    }
+    if failed {
+        os.Exit(1)
     }
 }
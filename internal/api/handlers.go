@@ -14,12 +14,82 @@ import (
 )
 
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
-	id, mode, err := jobs.CreateAndQueue(r)
+	batch, err := jobs.IsBatchUpload(r)
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, err)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]string{"id": id, "mode": mode})
+	if batch {
+		uploadBatch(w, r)
+		return
+	}
+	j, created, err := jobs.CreateAndQueue(r)
+	switch {
+	case errors.Is(err, jobs.ErrQueueFull):
+		w.Header().Set("Retry-After", "30")
+		writeErr(w, http.StatusServiceUnavailable, err)
+	case errors.Is(err, jobs.ErrIdempotencyKeyReused), errors.Is(err, jobs.ErrCallbackConflict):
+		writeErr(w, http.StatusUnprocessableEntity, err)
+	case err != nil:
+		writeErr(w, http.StatusBadRequest, err)
+	case !created:
+		writeJSON(w, http.StatusOK, map[string]any{"id": j.ID, "mode": j.Mode, "existing": true})
+	default:
+		writeJSON(w, http.StatusOK, map[string]any{"id": j.ID, "mode": j.Mode})
+	}
+}
+
+// uploadBatch creates a job for each file of a multi-file or zip upload
+func uploadBatch(w http.ResponseWriter, r *http.Request) {
+	b, err := jobs.CreateBatch(r)
+	switch {
+	case errors.Is(err, jobs.ErrQueueFull):
+		w.Header().Set("Retry-After", "30")
+		writeErr(w, http.StatusServiceUnavailable, err)
+	case errors.Is(err, jobs.ErrBatchTooLarge):
+		writeErr(w, http.StatusRequestEntityTooLarge, err)
+	case err != nil:
+		writeErr(w, http.StatusBadRequest, err)
+	default:
+		ids := make([]string, len(b.Jobs))
+		for i, j := range b.Jobs {
+			ids[i] = j.ID
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"batch_id": b.ID, "jobs": ids})
+	}
+}
+
+func BatchStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(id); err != nil {
+		writeErr(w, http.StatusBadRequest, errors.New("invalid id"))
+		return
+	}
+	b, ok := jobs.BatchStatus(id)
+	if !ok {
+		writeErr(w, http.StatusBadRequest, errors.New("invalid id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, b)
+}
+
+func BatchDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	jobs.ServeBatchDownload(w, r, id)
+}
+
+func ListHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := jobs.ParseJobQuery(r.URL.Query())
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	page, err := jobs.Jobs.Query(q)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
 }
 
 func StatusHandler(w http.ResponseWriter, r *http.Request) {
@@ -28,7 +98,7 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 		writeErr(w, http.StatusBadRequest, errors.New("invalid id"))
 		return
 	}
-	j, ok := jobs.Get(id)
+	j, ok := jobs.Status(id)
 	if !ok {
 		writeErr(w, http.StatusBadRequest, errors.New("invalid id"))
 		return
@@ -41,6 +111,76 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	jobs.ServeDownload(w, r, id)
 }
 
+func QuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	jobs.ServeQuarantine(w, r, id)
+}
+
+func StatsReportHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	jobs.ServeStatsReport(w, r, id)
+}
+
+func DomainsReportHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	jobs.ServeDomainsReport(w, r, id)
+}
+
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(id); err != nil {
+		writeErr(w, http.StatusBadRequest, errors.New("invalid id"))
+		return
+	}
+	jobs.ServeEvents(w, r, id)
+}
+
+func MonitorHandler(w http.ResponseWriter, r *http.Request) {
+	jobs.ServeMonitor(w, r)
+}
+
+// CancelHandler stops a queued or in-progress job. The canceller is taken from
+// the X-User header, falling back to the client address.
+func CancelHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(id); err != nil {
+		writeErr(w, http.StatusBadRequest, errors.New("invalid id"))
+		return
+	}
+	j, err := jobs.Cancel(id, jobs.ClientID(r))
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		writeErr(w, http.StatusBadRequest, err)
+	case errors.Is(err, jobs.ErrJobFinished):
+		writeErr(w, http.StatusConflict, err)
+	default:
+		writeJSON(w, http.StatusOK, j)
+	}
+}
+
+// RetryHandler runs a failed job again from its stored upload
+func RetryHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(id); err != nil {
+		writeErr(w, http.StatusBadRequest, errors.New("invalid id"))
+		return
+	}
+	j, err := jobs.Retry(id)
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		writeErr(w, http.StatusBadRequest, err)
+	case errors.Is(err, jobs.ErrNotFailed):
+		writeErr(w, http.StatusConflict, err)
+	case errors.Is(err, jobs.ErrUploadGone):
+		writeErr(w, http.StatusGone, err)
+	case errors.Is(err, jobs.ErrQueueFull):
+		w.Header().Set("Retry-After", "30")
+		writeErr(w, http.StatusServiceUnavailable, err)
+	default:
+		writeJSON(w, http.StatusOK, j)
+	}
+}
+
 func SwaggerJSON(w http.ResponseWriter, r *http.Request) {
 	spec := `{"openapi":"3.0.3","info":{"title":"CSV Email Flagger API","version":"1.0.0"}}`
 	w.Header().Set("Content-Type", "application/json")
@@ -10,6 +10,17 @@ func RegisterRoutes(r *mux.Router) {
 	r.HandleFunc("/api/upload", UploadHandler).Methods(http.MethodPost)
 	r.HandleFunc("/api/status/{id}", StatusHandler).Methods(http.MethodGet)
 	r.HandleFunc("/api/download/{id}", DownloadHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/download/{id}/quarantine", QuarantineHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/jobs", ListHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/jobs/{id}", CancelHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/api/jobs/{id}/cancel", CancelHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/jobs/{id}/retry", RetryHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/jobs/{id}/events", EventsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/jobs/{id}/reports/stats", StatsReportHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/jobs/{id}/reports/domains", DomainsReportHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/batches/{id}", BatchStatusHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/batches/{id}/download", BatchDownloadHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/ws", MonitorHandler).Methods(http.MethodGet)
 	r.HandleFunc("/api/cleanup", CleanupHandler).Methods(http.MethodPost)
 	r.HandleFunc("/swagger.json", SwaggerJSON).Methods(http.MethodGet)
 	r.HandleFunc("/healthz", Health).Methods(http.MethodGet)
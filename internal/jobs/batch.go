@@ -0,0 +1,468 @@
+package jobs
+
+import (
+	"archive/zip"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"csv-email-flagger/internal/storage"
+	"csv-email-flagger/internal/transform"
+	"csv-email-flagger/pkg/logger"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultBatchFiles is the number of files a batch upload may hold unless
+	// MAX_BATCH_FILES says otherwise
+	DefaultBatchFiles = 100
+	// DefaultBatchFileBytes caps each file of a batch, once unzipped, unless
+	// MAX_BATCH_FILE_BYTES says otherwise
+	DefaultBatchFileBytes = 256 << 20
+	// DefaultBatchBytes caps all files of a batch together, once unzipped,
+	// unless MAX_BATCH_BYTES says otherwise
+	DefaultBatchBytes = 1 << 30
+	// maxZipEntries caps the entries of a zip archive, skipped ones included
+	maxZipEntries = 10000
+	// batchTopDomains is how many domains BatchStats.TopDomains lists
+	batchTopDomains = 10
+)
+
+var (
+	// ErrBatchTooLarge rejects a batch upload with too many files or too
+	// many bytes once unzipped
+	ErrBatchTooLarge = errors.New("batch upload too large")
+	errBatchDedupe   = errors.New("idempotency keys and dedupe are not supported for batch uploads")
+)
+
+// batchLimits bounds the unzipped size of a batch upload
+type batchLimits struct {
+	file  int64
+	total int64
+}
+
+func newBatchLimits() batchLimits {
+	return batchLimits{
+		file:  int64(envLimit("MAX_BATCH_FILE_BYTES", DefaultBatchFileBytes)),
+		total: int64(envLimit("MAX_BATCH_BYTES", DefaultBatchBytes)),
+	}
+}
+
+// Batch is the combined view of the jobs created by one batch upload
+type Batch struct {
+	ID        string            `json:"id"`
+	Status    JobStatus         `json:"status"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Files     []BatchFile       `json:"files"`
+	Counts    map[JobStatus]int `json:"counts"`
+	Stats     *BatchStats       `json:"stats,omitempty"`
+	Jobs      []Job             `json:"jobs"`
+}
+
+// BatchFile is a file of a batch upload and the job created for it
+type BatchFile struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	JobID string `json:"job_id"`
+}
+
+// batchRecord is saved when a batch is created, so that the batch is known
+// by its own record rather than pieced together from jobs
+type batchRecord struct {
+	ID        string      `json:"id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Files     []BatchFile `json:"files"`
+}
+
+// BatchStats adds up the stats of the finished jobs of a batch. Distinct
+// addresses are not summed, as the same address may appear in several files.
+// TopDomains merges the top domains of each job, so once several jobs have
+// stats it is approximate: a domain outside every job's own top list is
+// missing, and counts may be low.
+type BatchStats struct {
+	RowsRead         int                     `json:"rows_read"`
+	RowsWritten      int                     `json:"rows_written"`
+	BlankRowsSkipped int                     `json:"blank_rows_skipped"`
+	RowsWithEmail    int                     `json:"rows_with_email"`
+	MalformedRows    int                     `json:"malformed_rows"`
+	PaddedRows       int                     `json:"padded_rows"`
+	TruncatedRows    int                     `json:"truncated_rows"`
+	RejectedRows     int                     `json:"rejected_rows"`
+	TopDomains       []transform.DomainCount `json:"top_domains"`
+	// TopDomainsApproximate is set when TopDomains was merged from several jobs
+	TopDomainsApproximate bool `json:"top_domains_approximate"`
+}
+
+// batchFile is one file of a batch upload: a multipart file or a zip entry
+type batchFile struct {
+	name string
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+func isZip(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".zip")
+}
+
+// IsBatchUpload parses the form of an upload and reports whether it holds
+// several files or a zip archive
+func IsBatchUpload(r *http.Request) (bool, error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return false, err
+	}
+	files := r.MultipartForm.File["file"]
+	return len(files) > 1 || (len(files) == 1 && isZip(files[0].Filename)), nil
+}
+
+// batchFiles lists the files of a batch upload, expanding zip archives. Entries
+// in directories are named by their base name; hidden files and macOS resource
+// forks are skipped. The sizes the archives declare are checked against
+// limits here, and enforced as the files are read.
+func batchFiles(r *http.Request, limits batchLimits) ([]batchFile, func(), error) {
+	var files []batchFile
+	var archives []io.Closer
+	closeAll := func() {
+		for _, c := range archives {
+			c.Close()
+		}
+	}
+	for _, fh := range r.MultipartForm.File["file"] {
+		if !isZip(fh.Filename) {
+			files = append(files, batchFile{name: fh.Filename, size: fh.Size, open: func() (io.ReadCloser, error) { return fh.Open() }})
+			continue
+		}
+		f, err := fh.Open()
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		archives = append(archives, f)
+		zr, err := zip.NewReader(f, fh.Size)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("invalid zip archive %q: %w", fh.Filename, err)
+		}
+		if len(zr.File) > maxZipEntries {
+			closeAll()
+			return nil, nil, fmt.Errorf("%w: zip archive %q holds more than %d entries", ErrBatchTooLarge, fh.Filename, maxZipEntries)
+		}
+		for _, entry := range zr.File {
+			name := path.Base(entry.Name)
+			if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") || strings.HasPrefix(name, ".") {
+				continue
+			}
+			files = append(files, batchFile{name: name, size: int64(entry.UncompressedSize64), open: entry.Open})
+		}
+	}
+	if len(files) == 0 {
+		closeAll()
+		return nil, nil, errors.New("batch upload contains no files")
+	}
+	if limit := envLimit("MAX_BATCH_FILES", DefaultBatchFiles); len(files) > limit {
+		closeAll()
+		return nil, nil, fmt.Errorf("%w: %d files, more than the limit of %d", ErrBatchTooLarge, len(files), limit)
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+		if err := limits.check(f.name, f.size, total); err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+	}
+	return files, closeAll, nil
+}
+
+// check reports a file of size bytes, bringing the batch to total, that is
+// over a limit
+func (l batchLimits) check(name string, size, total int64) error {
+	if size > l.file {
+		return fmt.Errorf("%w: %s is larger than the limit of %d bytes", ErrBatchTooLarge, name, l.file)
+	}
+	if total > l.total {
+		return fmt.Errorf("%w: the files are larger than the limit of %d bytes together", ErrBatchTooLarge, l.total)
+	}
+	return nil
+}
+
+// CreateBatch creates and queues a job for each file of a batch upload, with
+// the options of the upload applied to every job. Either every job is queued
+// or none: it returns ErrQueueFull if the queue cannot take them all.
+func CreateBatch(r *http.Request) (Batch, error) {
+	if r.Header.Get(IdempotencyKeyHeader) != "" || r.FormValue("dedupe") != "" {
+		return Batch{}, errBatchDedupe
+	}
+	limits := newBatchLimits()
+	files, closeFiles, err := batchFiles(r, limits)
+	if err != nil {
+		return Batch{}, err
+	}
+	defer closeFiles()
+
+	batchID := uuid.NewString()
+	children := make([]*Job, len(files))
+	for i, f := range files {
+		if children[i], err = newJob(r, f.name, f.size); err != nil {
+			return Batch{}, fmt.Errorf("%s: %w", f.name, err)
+		}
+		children[i].BatchID = batchID
+	}
+
+	for i := range children {
+		if err := queue.reserve(); err != nil {
+			for range i {
+				queue.release()
+			}
+			return Batch{}, err
+		}
+	}
+	// discard removes the stored uploads and gives back the queue places
+	discard := func() {
+		for _, j := range children {
+			storage.CleanupJobFiles(j.ID)
+			queue.release()
+		}
+	}
+	// Declared sizes may lie, so reading stops just past the limits
+	var total int64
+	for i, f := range files {
+		rc, err := f.open()
+		if err == nil {
+			err = children[i].saveUpload(io.LimitReader(rc, min(limits.file, limits.total-total)+1))
+			rc.Close()
+		}
+		if err == nil {
+			total += children[i].Size
+			err = limits.check(f.name, children[i].Size, total)
+		}
+		if err != nil {
+			discard()
+			if errors.Is(err, ErrBatchTooLarge) {
+				return Batch{}, err
+			}
+			return Batch{}, fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+
+	rec := batchRecord{ID: batchID, CreatedAt: time.Now()}
+	for i, j := range children {
+		rec.Files = append(rec.Files, BatchFile{Name: files[i].name, Size: j.Size, JobID: j.ID})
+	}
+	if err := writeBatchRecord(rec); err != nil {
+		discard()
+		return Batch{}, err
+	}
+
+	// Create every job before starting any, so the batch is complete from
+	// its first status
+	contexts := make([]context.Context, len(children))
+	for i, j := range children {
+		var cancel context.CancelCauseFunc
+		contexts[i], cancel = context.WithCancelCause(context.Background())
+		j.cancel = cancel
+		Jobs.Create(j)
+	}
+	for i, j := range children {
+		queue.push(contexts[i], j, true)
+	}
+	b, _ := BatchStatus(batchID)
+	return b, nil
+}
+
+// writeBatchRecord saves the record of a new batch
+func writeBatchRecord(rec batchRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(storage.GetBatchFilePath(rec.ID), data, 0o644)
+}
+
+// readBatchRecord loads the record of a batch
+func readBatchRecord(id string) (batchRecord, error) {
+	var rec batchRecord
+	data, err := os.ReadFile(storage.GetBatchFilePath(id))
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+// BatchStatus returns the combined status of the jobs of a batch, in the order
+// of its files
+func BatchStatus(id string) (Batch, bool) {
+	if uuid.Validate(id) != nil {
+		return Batch{}, false
+	}
+	rec, err := readBatchRecord(id)
+	if err != nil {
+		return Batch{}, false
+	}
+	b := Batch{ID: id, CreatedAt: rec.CreatedAt, UpdatedAt: rec.CreatedAt, Files: rec.Files, Counts: make(map[JobStatus]int)}
+	for _, f := range rec.Files {
+		if j, ok := Jobs.Snapshot(f.JobID); ok {
+			b.Jobs = append(b.Jobs, j)
+		}
+	}
+	if len(b.Jobs) == 0 {
+		return Batch{}, false
+	}
+
+	withStats := 0
+	domains := make(map[string]int64)
+	for _, j := range b.Jobs {
+		b.Counts[j.Status]++
+		if j.UpdatedAt.After(b.UpdatedAt) {
+			b.UpdatedAt = j.UpdatedAt
+		}
+		if j.Stats == nil {
+			continue
+		}
+		if b.Stats == nil {
+			b.Stats = &BatchStats{}
+		}
+		withStats++
+		s := j.Stats
+		b.Stats.RowsRead += s.RowsRead
+		b.Stats.RowsWritten += s.RowsWritten
+		b.Stats.BlankRowsSkipped += s.BlankRowsSkipped
+		b.Stats.RowsWithEmail += s.RowsWithEmail
+		b.Stats.MalformedRows += s.MalformedRows
+		b.Stats.PaddedRows += s.PaddedRows
+		b.Stats.TruncatedRows += s.TruncatedRows
+		b.Stats.RejectedRows += s.RejectedRows
+		for _, d := range s.TopDomains {
+			domains[d.Domain] += d.Count
+		}
+	}
+	if b.Stats != nil {
+		for domain, n := range domains {
+			b.Stats.TopDomains = append(b.Stats.TopDomains, transform.DomainCount{Domain: domain, Count: n})
+		}
+		slices.SortFunc(b.Stats.TopDomains, func(a, b transform.DomainCount) int {
+			return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Domain, b.Domain))
+		})
+		b.Stats.TopDomains = b.Stats.TopDomains[:min(len(b.Stats.TopDomains), batchTopDomains)]
+		b.Stats.TopDomainsApproximate = withStats > 1
+	}
+	b.Status = batchStatus(b.Counts, len(b.Jobs))
+	return b, true
+}
+
+// batchStatus sums up the statuses of n jobs: QUEUED until one starts, then
+// IN_PROGRESS until all have finished. A finished batch is DONE if every job
+// is, FAILED or CANCELLED if no job produced output, and DONE_WITH_ERRORS
+// otherwise.
+func batchStatus(counts map[JobStatus]int, n int) JobStatus {
+	switch {
+	case counts[StatusQueued] == n:
+		return StatusQueued
+	case counts[StatusQueued] > 0 || counts[StatusInProgress] > 0:
+		return StatusInProgress
+	case counts[StatusDone] == n:
+		return StatusDone
+	case counts[StatusCancelled] == n:
+		return StatusCancelled
+	case counts[StatusDone]+counts[StatusDoneWithErrors] == 0:
+		return StatusFailed
+	}
+	return StatusDoneWithErrors
+}
+
+// ServeBatchDownload streams a zip of the outputs of the jobs of a finished
+// batch that produced one, each in its job's output format and named after
+// its upload
+func ServeBatchDownload(w http.ResponseWriter, r *http.Request, id string) {
+	b, ok := BatchStatus(id)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if !b.Status.Terminal() {
+		http.Error(w, "batch in progress", http.StatusLocked)
+		return
+	}
+	var done []Job
+	for _, j := range b.Jobs {
+		if j.Status == StatusDone || j.Status == StatusDoneWithErrors {
+			done = append(done, j)
+		}
+	}
+	if len(done) == 0 {
+		http.Error(w, "no job in the batch produced output", http.StatusNotFound)
+		return
+	}
+
+	// Every output is opened before the response starts, so that a missing
+	// one can still be answered with an error status
+	files := make([]*os.File, 0, len(done))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, j := range done {
+		f, err := os.Open(j.Output)
+		if err != nil {
+			logger.Log.WithError(err).WithFields(logrus.Fields{"batch_id": id, "job_id": j.ID}).Error("job output missing from batch download")
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, "job output no longer available", http.StatusNotFound)
+			} else {
+				http.Error(w, "job output not readable", http.StatusInternalServerError)
+			}
+			return
+		}
+		files = append(files, f)
+	}
+
+	// From here on the status is sent, so a failure aborts the response and
+	// the client sees a truncated download rather than a valid-looking zip
+	w.Header().Set("Content-Type", "application/zip")
+	setAttachment(w, "batch-"+id+".zip")
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool)
+	for i, j := range done {
+		format := cmp.Or(j.OutputFormat, transform.FormatCSV)
+		name := downloadName(&j, ".flagged"+format.Extension())
+		for n := 2; names[name]; n++ {
+			name = downloadName(&j, fmt.Sprintf(" (%d).flagged%s", n, format.Extension()))
+		}
+		names[name] = true
+		if err := writeBatchEntry(zw, name, &j, files[i], format); err != nil {
+			logger.Log.WithError(err).WithFields(logrus.Fields{"batch_id": id, "job_id": j.ID}).Error("failed to add job output to batch download")
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		logger.Log.WithError(err).WithField("batch_id", id).Error("failed to finish batch download")
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func writeBatchEntry(zw *zip.Writer, name string, j *Job, f *os.File, format transform.Format) error {
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: j.UpdatedAt})
+	if err != nil {
+		return err
+	}
+	stored := transform.FormatFromFilename(j.Output)
+	if format == stored {
+		_, err = io.Copy(entry, f)
+		return err
+	}
+	return convertOutput(entry, f, stored, format, j.RowGroupSize)
+}
@@ -0,0 +1,98 @@
+package jobs
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"csv-email-flagger/internal/transform"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Checkpoint is the last point at which the output of a running job was known
+// to be complete. It is saved with the job so that a job interrupted by a
+// restart resumes from there instead of starting over.
+type Checkpoint struct {
+	transform.Checkpoint
+	OutputSize int64     `json:"output_size"`
+	At         time.Time `json:"at"`
+}
+
+// resumable reports whether a job can be checkpointed. Only CSV input can be
+// resumed at a byte offset and only CSV output cut back to one. The error
+// budget of lenient jobs and of jobs rejecting long rows, and the domain
+// report, depend on every row before the checkpoint.
+func resumable(j *Job) bool {
+	isCSV := j.InputFormat == transform.FormatCSV || j.InputFormat == ""
+	return isCSV && storedFormat(j) == transform.FormatCSV && !j.Lenient &&
+		j.LongRows != transform.LongRowsReject && !j.DomainReport
+}
+
+// openOutput creates the output file of a job. A job with a checkpoint
+// instead reopens its output truncated to the checkpoint, with in moved to the
+// matching offset, and gets the checkpoint back to resume from.
+func openOutput(j *Job, in *os.File, outPath string, log *logrus.Entry) (*os.File, *transform.Checkpoint, error) {
+	snap, _ := Jobs.Snapshot(j.ID)
+	cp := snap.Checkpoint
+	if cp == nil || !resumable(j) {
+		out, err := os.Create(outPath)
+		return out, nil, err
+	}
+
+	out, err := os.OpenFile(outPath, os.O_RDWR, 0)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = out.Stat(); err == nil && info.Size() < cp.OutputSize {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			err = out.Truncate(cp.OutputSize)
+		}
+		if err == nil {
+			_, err = out.Seek(cp.OutputSize, io.SeekStart)
+		}
+		if err == nil {
+			_, err = in.Seek(cp.InputOffset, io.SeekStart)
+		}
+		if err == nil {
+			log.WithFields(logrus.Fields{"input_offset": cp.InputOffset, "rows": cp.Rows}).Info("resuming from checkpoint")
+			return out, &cp.Checkpoint, nil
+		}
+		out.Close()
+	}
+
+	// Start over if the partial output is unusable
+	log.WithError(err).Warn("cannot resume from checkpoint, starting over")
+	Jobs.Update(j.ID, func(j *Job) { j.Checkpoint = nil })
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	out, err = os.Create(outPath)
+	return out, nil, err
+}
+
+// checkpointRecorder returns a transform checkpoint callback that saves each
+// checkpoint on the job with id, along with the size out has reached
+func checkpointRecorder(id string, out *os.File, log *logrus.Entry) func(transform.Checkpoint) {
+	return func(c transform.Checkpoint) {
+		size, err := out.Seek(0, io.SeekCurrent)
+		if err != nil {
+			log.WithError(err).Warn("failed to checkpoint")
+			return
+		}
+		Jobs.Update(id, func(j *Job) {
+			j.Checkpoint = &Checkpoint{Checkpoint: c, OutputSize: size, At: time.Now()}
+		})
+	}
+}
+
+// checkpointInterval is the input consumed between checkpoints, from
+// CHECKPOINT_BYTES
+func checkpointInterval() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("CHECKPOINT_BYTES"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return transform.DefaultCheckpointInterval
+}
@@ -0,0 +1,104 @@
+package jobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// IdempotencyKeyHeader names the header that makes retried uploads return the
+// job created by the first attempt
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKey caps the length of an idempotency key
+const maxIdempotencyKey = 255
+
+var (
+	// ErrIdempotencyKeyReused rejects an upload whose idempotency key was
+	// already used by the same client for a different file or options
+	ErrIdempotencyKeyReused = errors.New("idempotency key already used for a different upload")
+	errIdempotencyKeyLength = errors.New("idempotency key must be at most 255 characters")
+	// ErrCallbackConflict rejects an upload answered by an existing job when it
+	// asks for a callback that job does not have
+	ErrCallbackConflict = errors.New("callback_url differs from the callback of the existing job serving this upload")
+)
+
+// idempotencyKey reads the Idempotency-Key header of an upload
+func idempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKey {
+		return "", errIdempotencyKeyLength
+	}
+	return key, nil
+}
+
+// dedupeRequested reports whether an upload asks to reuse a job with the same
+// content and options, through its dedupe field or else DEDUPE_UPLOADS
+func dedupeRequested(r *http.Request) (bool, error) {
+	v := r.FormValue("dedupe")
+	if v == "" {
+		on, _ := strconv.ParseBool(os.Getenv("DEDUPE_UPLOADS"))
+		return on, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("dedupe must be true or false")
+	}
+	return on, nil
+}
+
+// fingerprint identifies the output of a job: the hash of its upload and the
+// options that change what it produces. Scheduling options, tags, labels and
+// metadata are left out.
+func fingerprint(j *Job) string {
+	h := sha256.New()
+	h.Write([]byte(j.SHA256))
+	json.NewEncoder(h).Encode(struct {
+		InputFormat   string  `json:"input_format"`
+		OutputFormat  string  `json:"output_format"`
+		RowGroupSize  int     `json:"row_group_size"`
+		Lenient       bool    `json:"lenient"`
+		MaxErrors     int     `json:"max_errors"`
+		MaxErrorRatio float64 `json:"max_error_ratio"`
+		PadShortRows  bool    `json:"pad_short_rows"`
+		LongRows      string  `json:"long_rows"`
+		DomainReport  bool    `json:"domain_report"`
+	}{
+		string(j.InputFormat), string(j.OutputFormat), j.RowGroupSize,
+		j.Lenient, j.MaxErrors, j.MaxErrorRatio,
+		j.PadShortRows, string(j.LongRows), j.DomainReport,
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// reusable reports whether a duplicate upload may be answered with j: it has
+// not failed or been cancelled, and its output has not been cleaned up
+func (j *Job) reusable() bool {
+	switch j.Status {
+	case StatusQueued, StatusInProgress:
+		return true
+	case StatusDone, StatusDoneWithErrors:
+		_, err := os.Stat(j.Output)
+		return err == nil
+	}
+	return false
+}
+
+// idempotencyScope keys an idempotency key by the client that sent it
+func idempotencyScope(client, key string) string {
+	return client + "\x00" + key
+}
+
+// checkCallback accepts an upload answered by existing if it asked for no
+// callback or for the one existing already has. A callback is never attached
+// to a job afterwards, as it may have finished already.
+func checkCallback(existing Job, j *Job) error {
+	if j.Webhook == nil || (existing.Webhook != nil && existing.Webhook.URL == j.Webhook.URL) {
+		return nil
+	}
+	return ErrCallbackConflict
+}
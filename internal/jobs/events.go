@@ -0,0 +1,98 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// sseProgressInterval is the minimum time between progress messages
+	sseProgressInterval = 500 * time.Millisecond
+	// sseKeepAlive is how often an idle stream sends a comment to stay open
+	sseKeepAlive = 15 * time.Second
+	// sseBuffer is the number of events held for a stream before it lags
+	sseBuffer = 64
+)
+
+// ServeEvents streams the status transitions and progress of a job as
+// Server-Sent Events, starting with its current state, and ends the stream
+// once the job reaches a terminal status
+func ServeEvents(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	// Subscribe before taking the snapshot so no transition falls in between
+	sub := Events.Subscribe(func(e Event) bool { return e.JobID == id }, sseBuffer)
+	defer Events.Unsubscribe(sub)
+
+	j, ok := Jobs.Snapshot(id)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e Event) bool {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return false
+		}
+		if e.Seq > 0 {
+			fmt.Fprintf(w, "id: %d\n", e.Seq)
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if !send(newEvent(EventStatus, &j)) || j.Status.Terminal() {
+		return
+	}
+
+	// The ticker also catches up after dropped events, which might include the
+	// terminal transition that would otherwise never arrive
+	ticker := time.NewTicker(sseProgressInterval)
+	defer ticker.Stop()
+	var lastProgress time.Time
+	lastWrite := time.Now()
+	for {
+		select {
+		case e := <-sub.C:
+			if e.Type == EventProgress {
+				if time.Since(lastProgress) < sseProgressInterval {
+					continue
+				}
+				lastProgress = time.Now()
+			}
+			if !send(e) || e.Status.Terminal() {
+				return
+			}
+			lastWrite = time.Now()
+		case <-ticker.C:
+			if sub.Lagged() {
+				if j, ok = Jobs.Snapshot(id); !ok || !send(newEvent(EventStatus, &j)) || j.Status.Terminal() {
+					return
+				}
+				lastWrite = time.Now()
+			} else if time.Since(lastWrite) >= sseKeepAlive {
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+				lastWrite = time.Now()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
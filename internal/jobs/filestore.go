@@ -0,0 +1,191 @@
+package jobs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+
+	"csv-email-flagger/pkg/logger"
+)
+
+// ErrInterrupted is recorded on jobs that were running when the server stopped
+// and whose upload is gone, so they cannot run again
+var ErrInterrupted = errors.New("interrupted by restart")
+
+// logRecord is a job as written to the log, including the fields the API hides
+type logRecord struct {
+	*Job
+	InputPath   string `json:"input_path"`
+	Output      string `json:"output,omitempty"`
+	WebhookBase string `json:"webhook_base,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// compactMinRecords is the smallest log that is compacted while the store is
+// open
+const compactMinRecords = 1000
+
+// FileStore is a MemoryStore that appends every change of a job to a log file,
+// one JSON record per line, so jobs survive restarts. The log is compacted to a
+// single record per job each time it is opened, and again whenever it holds
+// more than twice as many records as there are jobs.
+type FileStore struct {
+	*MemoryStore
+	path    string
+	f       *os.File
+	w       *bufio.Writer
+	records int
+}
+
+// OpenFileStore loads the jobs recorded at path, creating the log if needed.
+// Jobs that were queued or running when the log was last written are queued
+// again if their upload still exists, and failed with ErrInterrupted
+// otherwise; ResumeInterrupted starts them. ResumeWebhooks carries on the
+// webhook deliveries of finished jobs.
+func OpenFileStore(path string, events *Hub) (*FileStore, error) {
+	mem := NewMemoryStore(events)
+	if err := mem.load(path); err != nil {
+		return nil, err
+	}
+	for _, j := range mem.jobs {
+		if j.Status != StatusQueued && j.Status != StatusInProgress {
+			continue
+		}
+		j.Progress = nil
+		if _, err := os.Stat(j.InputPath); err == nil {
+			j.Status = StatusQueued
+		} else {
+			j.Status = StatusFailed
+			j.Error = ErrInterrupted.Error()
+		}
+	}
+	for _, j := range mem.jobs {
+		mem.index.add(j)
+	}
+	if err := mem.compact(path); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{MemoryStore: mem, path: path, f: f, w: bufio.NewWriter(f), records: len(mem.jobs)}
+	mem.save = s.append
+	return s, nil
+}
+
+// load replays the log at path. A record cut short by a crash ends the replay.
+func (s *MemoryStore) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		rec := logRecord{Job: &Job{}}
+		if err := dec.Decode(&rec); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Log.WithError(err).WithField("path", path).Warn("ignoring the unreadable end of the job log")
+			}
+			return nil
+		}
+		rec.Job.InputPath = rec.InputPath
+		rec.Job.Output = rec.Output
+		rec.Job.Fingerprint = rec.Fingerprint
+		if rec.Job.Webhook != nil {
+			rec.Job.Webhook.downloadURL = rec.WebhookBase
+		}
+		s.jobs[rec.Job.ID] = rec.Job
+	}
+}
+
+// compact replaces the log at path with the current record of every job
+func (s *MemoryStore) compact(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, j := range s.jobs {
+		if err = writeRecord(w, j); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeRecord(w *bufio.Writer, j *Job) error {
+	rec := logRecord{Job: j, InputPath: j.InputPath, Output: j.Output, Fingerprint: j.Fingerprint}
+	if j.Webhook != nil {
+		rec.WebhookBase = j.Webhook.downloadURL
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	w.Write(data)
+	return w.WriteByte('\n')
+}
+
+// append is called by the MemoryStore with its lock held
+func (s *FileStore) append(j *Job) {
+	err := writeRecord(s.w, j)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		logger.Log.WithError(err).WithField("job_id", j.ID).Error("failed to write job log")
+		return
+	}
+	s.records++
+	if s.records > max(compactMinRecords, 2*len(s.jobs)) {
+		if err := s.rotate(); err != nil {
+			logger.Log.WithError(err).WithField("path", s.path).Error("failed to compact job log")
+		}
+	}
+}
+
+// rotate compacts the log and continues appending to the compacted file
+func (s *FileStore) rotate() error {
+	if err := s.compact(s.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f, s.w = f, bufio.NewWriter(f)
+	s.records = len(s.jobs)
+	return nil
+}
+
+// Close closes the log. The store must not be changed afterwards.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.save = nil
+	return s.f.Close()
+}
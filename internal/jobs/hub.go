@@ -0,0 +1,130 @@
+package jobs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types published by the JobStore
+const (
+	EventStatus   = "status"
+	EventProgress = "progress"
+)
+
+// hubHistory is the number of recent events a hub keeps for resuming clients
+const hubHistory = 4096
+
+// Event is a change to a job. Seq increases by one with every event published
+// by a hub, across all jobs.
+type Event struct {
+	Seq      uint64       `json:"seq"`
+	Type     string       `json:"type"`
+	JobID    string       `json:"job_id"`
+	Tags     []string     `json:"tags,omitempty"`
+	Status   JobStatus    `json:"status"`
+	Error    string       `json:"error,omitempty"`
+	Progress *JobProgress `json:"progress,omitempty"`
+	Time     time.Time    `json:"time"`
+}
+
+// Hub fans job events out to subscribers. Publishing never blocks: a
+// subscriber whose buffer is full misses the event and is marked as lagged, so
+// it can catch up from the store. The most recent events are kept so clients
+// can resume from the last sequence number they saw.
+type Hub struct {
+	mu      sync.Mutex
+	seq     uint64
+	subs    map[*Subscription]struct{}
+	history []Event // ring indexed by Seq % hubHistory
+}
+
+// Subscription receives the events accepted by its filter on C
+type Subscription struct {
+	C      <-chan Event
+	ch     chan Event
+	filter func(Event) bool
+	lagged atomic.Bool
+}
+
+// NewHub returns an empty Hub
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{}), history: make([]Event, hubHistory)}
+}
+
+// Subscribe registers a subscriber buffering up to buffer events. A nil filter
+// accepts every event.
+func (h *Hub) Subscribe(filter func(Event) bool, buffer int) *Subscription {
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, filter: filter}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe stops delivery to sub and closes its channel
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+	h.mu.Unlock()
+}
+
+// Publish assigns e the next sequence number and delivers it
+func (h *Hub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	e.Seq = h.seq
+	h.history[e.Seq%hubHistory] = e
+	for sub := range h.subs {
+		if sub.filter != nil && !sub.filter(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			sub.lagged.Store(true)
+		}
+	}
+}
+
+// Since returns the events after seq accepted by filter, oldest first. It
+// returns false when events after seq are no longer held, or seq is newer than
+// anything published, in which case the caller must resynchronise instead.
+func (h *Hub) Since(seq uint64, filter func(Event) bool) ([]Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seq > h.seq || h.seq-seq > hubHistory {
+		return nil, false
+	}
+	var events []Event
+	for s := seq + 1; s <= h.seq; s++ {
+		e := h.history[s%hubHistory]
+		if filter == nil || filter(e) {
+			events = append(events, e)
+		}
+	}
+	return events, true
+}
+
+// Lagged reports whether events were dropped since the last call
+func (s *Subscription) Lagged() bool {
+	return s.lagged.Swap(false)
+}
+
+// newEvent describes the current state of j
+func newEvent(typ string, j *Job) Event {
+	return Event{
+		Type:     typ,
+		JobID:    j.ID,
+		Tags:     j.Tags,
+		Status:   j.Status,
+		Error:    j.Error,
+		Progress: j.Progress,
+		Time:     j.UpdatedAt,
+	}
+}
@@ -0,0 +1,400 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPageSize is the number of jobs listed when a query sets no limit
+	DefaultPageSize = 50
+	// MaxPageSize caps the limit of a query
+	MaxPageSize = 500
+)
+
+// ErrInvalidCursor rejects a cursor that was not returned by a previous page
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// JobQuery selects jobs to list. Empty fields match every job.
+type JobQuery struct {
+	// Statuses matches jobs in any of these statuses
+	Statuses []JobStatus
+	Mode     string
+	// Tags matches jobs that have all of these tags
+	Tags []string
+	// Labels matches jobs that have all of these labels with the same values
+	Labels map[string]string
+	Batch  string
+	// CreatedAfter and CreatedBefore bound the creation time, inclusive
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Ascending lists the oldest jobs first instead of the newest
+	Ascending bool
+	Limit     int
+	// Cursor continues from the page that returned it
+	Cursor string
+}
+
+// JobPage is one page of a job listing. NextCursor is empty on the last page.
+type JobPage struct {
+	Jobs       []Job  `json:"jobs"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ParseJobQuery reads a JobQuery from the parameters of a listing request.
+// status and tag may be repeated or comma-separated, created_after and
+// created_before are RFC 3339 times, label takes key=value pairs, batch is a
+// batch ID and sort is created_at or -created_at.
+func ParseJobQuery(v url.Values) (JobQuery, error) {
+	var q JobQuery
+	for _, s := range splitValues(v["status"]) {
+		st := JobStatus(strings.ToUpper(s))
+		switch st {
+		case StatusQueued, StatusInProgress, StatusDone, StatusDoneWithErrors, StatusFailed, StatusCancelled:
+		default:
+			return JobQuery{}, fmt.Errorf("unsupported status %q", s)
+		}
+		q.Statuses = append(q.Statuses, st)
+	}
+	switch q.Mode = v.Get("mode"); q.Mode {
+	case "", "sequential", "parallel", "chunked":
+	default:
+		return JobQuery{}, fmt.Errorf("unsupported mode %q", q.Mode)
+	}
+	q.Tags = splitValues(v["tag"])
+	q.Batch = v.Get("batch")
+	var err error
+	if q.Labels, err = parseLabels(strings.Join(v["label"], ",")); err != nil {
+		return JobQuery{}, err
+	}
+
+	if s := v.Get("created_after"); s != "" {
+		if q.CreatedAfter, err = time.Parse(time.RFC3339, s); err != nil {
+			return JobQuery{}, errors.New("created_after must be an RFC 3339 time")
+		}
+	}
+	if s := v.Get("created_before"); s != "" {
+		if q.CreatedBefore, err = time.Parse(time.RFC3339, s); err != nil {
+			return JobQuery{}, errors.New("created_before must be an RFC 3339 time")
+		}
+	}
+	switch v.Get("sort") {
+	case "", "-created_at":
+	case "created_at":
+		q.Ascending = true
+	default:
+		return JobQuery{}, fmt.Errorf("unsupported sort %q", v.Get("sort"))
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 || q.Limit > MaxPageSize {
+			return JobQuery{}, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+		}
+	}
+	q.Cursor = v.Get("cursor")
+	return q, nil
+}
+
+func splitValues(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// jobKey orders jobs by creation time, then by ID for jobs created together
+type jobKey struct {
+	created time.Time
+	id      string
+}
+
+func keyOf(j *Job) jobKey {
+	return jobKey{created: j.CreatedAt, id: j.ID}
+}
+
+func (k jobKey) compare(o jobKey) int {
+	if c := k.created.Compare(o.created); c != 0 {
+		return c
+	}
+	return strings.Compare(k.id, o.id)
+}
+
+func (k jobKey) cursor() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(k.created.UnixNano(), 10) + ":" + k.id))
+}
+
+func parseCursor(s string) (jobKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return jobKey{}, ErrInvalidCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if !ok || err != nil || id == "" {
+		return jobKey{}, ErrInvalidCursor
+	}
+	return jobKey{created: time.Unix(0, n), id: id}, nil
+}
+
+// jobIndex keeps jobs sorted by creation time and grouped by status, tag,
+// label and batch, so listings read only the jobs that can match. It is guarded by the lock of
+// the store that owns it.
+type jobIndex struct {
+	byCreated []*Job
+	byStatus  map[JobStatus]map[string]*Job
+	byTag     map[string]map[string]*Job
+	byLabel   map[string]map[string]*Job // keyed by "key=value"
+	byBatch   map[string]map[string]*Job
+	// byKey finds jobs by client and idempotency key, byFingerprint by the
+	// upload and options that produced them
+	byKey         map[string]*Job
+	byFingerprint map[string]map[string]*Job
+}
+
+func newJobIndex() *jobIndex {
+	return &jobIndex{
+		byStatus: make(map[JobStatus]map[string]*Job),
+		byTag:    make(map[string]map[string]*Job),
+		byLabel:  make(map[string]map[string]*Job),
+		byBatch:  make(map[string]map[string]*Job),
+
+		byKey:         make(map[string]*Job),
+		byFingerprint: make(map[string]map[string]*Job),
+	}
+}
+
+func addTo[K comparable](m map[K]map[string]*Job, k K, j *Job) {
+	if m[k] == nil {
+		m[k] = make(map[string]*Job)
+	}
+	m[k][j.ID] = j
+}
+
+func removeFrom[K comparable](m map[K]map[string]*Job, k K, j *Job) {
+	delete(m[k], j.ID)
+	if len(m[k]) == 0 {
+		delete(m, k)
+	}
+}
+
+// add indexes a new job. Jobs mostly arrive in creation order, so the insert
+// is usually an append.
+func (x *jobIndex) add(j *Job) {
+	k := keyOf(j)
+	i, _ := slices.BinarySearchFunc(x.byCreated, k, func(e *Job, k jobKey) int { return keyOf(e).compare(k) })
+	x.byCreated = slices.Insert(x.byCreated, i, j)
+	addTo(x.byStatus, j.Status, j)
+	for _, tag := range j.Tags {
+		addTo(x.byTag, tag, j)
+	}
+	for k, v := range j.Labels {
+		addTo(x.byLabel, k+"="+v, j)
+	}
+	if j.BatchID != "" {
+		addTo(x.byBatch, j.BatchID, j)
+	}
+	if j.IdempotencyKey != "" {
+		x.byKey[idempotencyScope(j.Client, j.IdempotencyKey)] = j
+	}
+	if j.Fingerprint != "" {
+		addTo(x.byFingerprint, j.Fingerprint, j)
+	}
+}
+
+// byIdempotencyKey returns the job created earlier with the client and
+// idempotency key of j
+func (x *jobIndex) byIdempotencyKey(j *Job) (*Job, bool) {
+	if j.IdempotencyKey == "" {
+		return nil, false
+	}
+	existing, ok := x.byKey[idempotencyScope(j.Client, j.IdempotencyKey)]
+	return existing, ok
+}
+
+// byOutput returns the oldest reusable job with fingerprint
+func (x *jobIndex) byOutput(fingerprint string) (*Job, bool) {
+	var best *Job
+	for _, j := range x.byFingerprint[fingerprint] {
+		if j.reusable() && (best == nil || keyOf(j).compare(keyOf(best)) < 0) {
+			best = j
+		}
+	}
+	return best, best != nil
+}
+
+// statusChanged moves j from the status it had before
+func (x *jobIndex) statusChanged(j *Job, old JobStatus) {
+	if j.Status != old {
+		removeFrom(x.byStatus, old, j)
+		addTo(x.byStatus, j.Status, j)
+	}
+}
+
+func (q *JobQuery) matches(j *Job) bool {
+	if len(q.Statuses) > 0 && !slices.Contains(q.Statuses, j.Status) {
+		return false
+	}
+	if q.Mode != "" && j.Mode != q.Mode {
+		return false
+	}
+	if q.Batch != "" && j.BatchID != q.Batch {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !slices.Contains(j.Tags, tag) {
+			return false
+		}
+	}
+	for k, v := range q.Labels {
+		if jv, ok := j.Labels[k]; !ok || jv != v {
+			return false
+		}
+	}
+	if !q.CreatedAfter.IsZero() && j.CreatedAt.Before(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && j.CreatedAt.After(q.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// query returns copies of the jobs matching q, one page at a time. When the
+// statuses, tags, labels or batch asked for cover fewer jobs than the creation time range,
+// only those jobs are read and sorted; otherwise the range is walked in order.
+func (x *jobIndex) query(q JobQuery) (JobPage, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	limit = min(limit, MaxPageSize)
+	var after *jobKey
+	if q.Cursor != "" {
+		k, err := parseCursor(q.Cursor)
+		if err != nil {
+			return JobPage{}, err
+		}
+		after = &k
+	}
+	// beyond reports whether k comes after the cursor in listing order
+	beyond := func(k jobKey) bool {
+		if after == nil {
+			return true
+		}
+		if q.Ascending {
+			return k.compare(*after) > 0
+		}
+		return k.compare(*after) < 0
+	}
+
+	// The creation time range, narrowed by the cursor
+	lo, hi := 0, len(x.byCreated)
+	if !q.CreatedAfter.IsZero() {
+		lo, _ = slices.BinarySearchFunc(x.byCreated, q.CreatedAfter, func(e *Job, t time.Time) int { return e.CreatedAt.Compare(t) })
+	}
+	if !q.CreatedBefore.IsZero() {
+		hi, _ = slices.BinarySearchFunc(x.byCreated, q.CreatedBefore.Add(1), func(e *Job, t time.Time) int { return e.CreatedAt.Compare(t) })
+	}
+	if after != nil {
+		i, found := slices.BinarySearchFunc(x.byCreated, *after, func(e *Job, k jobKey) int { return keyOf(e).compare(k) })
+		if q.Ascending {
+			if found {
+				i++
+			}
+			lo = max(lo, i)
+		} else {
+			hi = min(hi, i)
+		}
+	}
+
+	var candidates []*Job
+	if set, ok := x.smallestSet(q, hi-lo); ok {
+		for _, j := range set {
+			if beyond(keyOf(j)) && q.matches(j) {
+				candidates = append(candidates, j)
+			}
+		}
+		slices.SortFunc(candidates, func(a, b *Job) int {
+			if q.Ascending {
+				return keyOf(a).compare(keyOf(b))
+			}
+			return keyOf(b).compare(keyOf(a))
+		})
+		if len(candidates) > limit+1 {
+			candidates = candidates[:limit+1]
+		}
+	} else {
+		for n := 0; n < hi-lo && len(candidates) <= limit; n++ {
+			i := hi - 1 - n
+			if q.Ascending {
+				i = lo + n
+			}
+			if j := x.byCreated[i]; q.matches(j) {
+				candidates = append(candidates, j)
+			}
+		}
+	}
+
+	page := JobPage{Jobs: make([]Job, 0, min(len(candidates), limit))}
+	for _, j := range candidates[:min(len(candidates), limit)] {
+		page.Jobs = append(page.Jobs, *j)
+	}
+	if len(candidates) > limit {
+		page.NextCursor = keyOf(candidates[limit-1]).cursor()
+	}
+	return page, nil
+}
+
+// smallestSet returns the jobs in the statuses, or with one of the tags or
+// labels or the batch of q, that number fewest, if that is less than rangeSize
+func (x *jobIndex) smallestSet(q JobQuery, rangeSize int) ([]*Job, bool) {
+	var best []*Job
+	found := false
+	consider := func(set []*Job) {
+		if !found || len(set) < len(best) {
+			best, found = set, true
+		}
+	}
+	if len(q.Statuses) > 0 {
+		var set []*Job
+		for _, st := range q.Statuses {
+			for _, j := range x.byStatus[st] {
+				set = append(set, j)
+			}
+		}
+		consider(set)
+	}
+	keys := func(m map[string]map[string]*Job, k string) {
+		if found && len(m[k]) >= len(best) {
+			return
+		}
+		set := make([]*Job, 0, len(m[k]))
+		for _, j := range m[k] {
+			set = append(set, j)
+		}
+		consider(set)
+	}
+	for _, tag := range q.Tags {
+		keys(x.byTag, tag)
+	}
+	for k, v := range q.Labels {
+		keys(x.byLabel, k+"="+v)
+	}
+	if q.Batch != "" {
+		keys(x.byBatch, q.Batch)
+	}
+	if !found || len(best) >= rangeSize {
+		return nil, false
+	}
+	return best, true
+}
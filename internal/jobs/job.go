@@ -1,17 +1,40 @@
 package jobs
 
 import (
+    "context"
+    "encoding/json"
+    "errors"
     "sync"
     "time"
+
+    "csv-email-flagger/internal/transform"
 )
 
 type JobStatus string
 
 const (
-    StatusQueued     JobStatus = "QUEUED"
-    StatusInProgress JobStatus = "IN_PROGRESS"
-    StatusDone       JobStatus = "DONE"
-    StatusFailed     JobStatus = "FAILED"
+    StatusQueued         JobStatus = "QUEUED"
+    StatusInProgress     JobStatus = "IN_PROGRESS"
+    StatusDone           JobStatus = "DONE"
+    StatusDoneWithErrors JobStatus = "DONE_WITH_ERRORS" // lenient job that skipped malformed rows
+    StatusFailed         JobStatus = "FAILED"
+    StatusCancelled      JobStatus = "CANCELLED"
+)
+
+// Terminal reports whether a job in this status will not change again
+func (s JobStatus) Terminal() bool {
+    switch s {
+    case StatusDone, StatusDoneWithErrors, StatusFailed, StatusCancelled:
+        return true
+    }
+    return false
+}
+
+var (
+    ErrJobNotFound = errors.New("invalid id")
+    ErrJobFinished = errors.New("job already finished")
+    // ErrJobCancelled is the cause attached to the context of a cancelled job
+    ErrJobCancelled = errors.New("job cancelled")
 )
 
 type Job struct {
@@ -23,34 +46,286 @@ type Job struct {
     CreatedAt time.Time `json:"created_at"`
     UpdatedAt time.Time `json:"updated_at"`
     Mode      string    `json:"mode"`
+    Workers   int       `json:"workers"`
+    Tags      []string  `json:"tags,omitempty"`
+    // BatchID is set on jobs created by a batch upload
+    BatchID string `json:"batch_id,omitempty"`
+
+    // Filename is the name the upload was sent with, without any directory
+    Filename string            `json:"filename,omitempty"`
+    Size     int64             `json:"size"`
+    SHA256   string            `json:"sha256,omitempty"`
+    Labels   map[string]string `json:"labels,omitempty"`
+    // Metadata is a JSON object supplied by the client and returned as is
+    Metadata json.RawMessage `json:"metadata,omitempty"`
+
+    IdempotencyKey string `json:"idempotency_key,omitempty"`
+    // Fingerprint hashes the upload with the options that shape the output,
+    // to find duplicate uploads
+    Fingerprint string `json:"-"`
+
+    Client   string   `json:"client,omitempty"`
+    Priority Priority `json:"priority,omitempty"`
+    // QueuePosition is the 1-based place of a queued job among those waiting,
+    // filled in by Status
+    QueuePosition int `json:"queue_position,omitempty"`
+
+    InputFormat  transform.Format `json:"input_format"`
+    OutputFormat transform.Format `json:"output_format"`
+    RowGroupSize int              `json:"row_group_size,omitempty"`
+
+    Lenient       bool    `json:"lenient,omitempty"`
+    MaxErrors     int     `json:"max_errors,omitempty"`
+    MaxErrorRatio float64 `json:"max_error_ratio,omitempty"`
+    MalformedRows int     `json:"malformed_rows,omitempty"`
+
+    PadShortRows bool                    `json:"pad_short_rows,omitempty"`
+    LongRows     transform.LongRowPolicy `json:"long_rows,omitempty"`
+
+    Stats        *transform.Stats `json:"stats,omitempty"`
+    DomainReport bool             `json:"domain_report,omitempty"`
+
+    Progress   *JobProgress `json:"progress,omitempty"`
+    Checkpoint *Checkpoint  `json:"checkpoint,omitempty"`
+
+    CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+    CancelledBy string     `json:"cancelled_by,omitempty"`
+
+    Webhook *Webhook `json:"webhook,omitempty"`
+
+    Attempts []Attempt `json:"attempts,omitempty"`
+    // RetryAt is when a job waiting to be retried after a transient failure
+    // goes back into the queue
+    RetryAt *time.Time `json:"retry_at,omitempty"`
+
+    cancel context.CancelCauseFunc
+    manual bool // the next run was started by Retry
+}
+
+// JobStore records jobs and publishes their changes to a Hub
+type JobStore interface {
+    Create(j *Job)
+    Get(id string) (*Job, bool)
+    // Snapshot returns a copy of the job taken under the store lock
+    Snapshot(id string) (Job, bool)
+    // List returns copies of the jobs accepted by match
+    List(match func(j *Job) bool) []Job
+    // Query returns a page of the jobs selected by q, newest first unless
+    // q.Ascending is set
+    Query(q JobQuery) (JobPage, error)
+    // Start moves a queued job to IN_PROGRESS. It returns false if the job is
+    // no longer queued, for example because it was cancelled.
+    Start(id string) bool
+    // Requeue applies fn to a failed job and moves it back to QUEUED. It
+    // returns false if the job has not failed.
+    Requeue(id string, fn func(j *Job)) bool
+    // Update applies fn to the job while holding the store lock
+    Update(id string, fn func(j *Job))
+    // SetStatus records a status change. Cancelled jobs keep their status.
+    SetStatus(id string, st JobStatus, err error)
+    // SetProgress records the progress of a running job
+    SetProgress(id string, p *JobProgress)
+    // Cancel marks a queued or in-progress job as cancelled by who and stops
+    // its processing. It returns a snapshot of the cancelled job.
+    Cancel(id, who string) (Job, error)
+    // CreateUnique creates j unless its client already used its idempotency
+    // key, or, when dedupe is set, a reusable job has the same fingerprint.
+    // It returns a snapshot of the job that serves the upload and whether it
+    // is j. A key used for a different fingerprint gives
+    // ErrIdempotencyKeyReused.
+    CreateUnique(j *Job, dedupe bool) (Job, bool, error)
+    // FindDuplicate returns a snapshot of the job CreateUnique would serve j
+    // with, without creating anything. It reports false if j would be created.
+    FindDuplicate(j *Job, dedupe bool) (Job, bool, error)
 }
 
-type JobStore struct {
-    mu   sync.RWMutex
-    jobs map[string]*Job
+// MemoryStore is a JobStore that keeps jobs in a map, indexed for Query.
+// Every change is passed to save, if set, while the lock is still held.
+type MemoryStore struct {
+    mu     sync.RWMutex
+    jobs   map[string]*Job
+    index  *jobIndex
+    events *Hub
+    save   func(j *Job)
 }
 
-var Jobs = &JobStore{jobs: make(map[string]*Job)}
+// Events receives a status event whenever a job changes state and progress
+// events while it runs
+var Events = NewHub()
 
-func (s *JobStore) Create(j *Job) {
+// Jobs is the store used by the service
+var Jobs JobStore = NewMemoryStore(Events)
+
+// NewMemoryStore returns an empty MemoryStore publishing to events
+func NewMemoryStore(events *Hub) *MemoryStore {
+    return &MemoryStore{jobs: make(map[string]*Job), index: newJobIndex(), events: events}
+}
+
+func (s *MemoryStore) saved(j *Job) {
+    if s.save != nil {
+        s.save(j)
+    }
+}
+
+func (s *MemoryStore) Create(j *Job) {
     s.mu.Lock()
     s.jobs[j.ID] = j
+    s.index.add(j)
+    s.saved(j)
+    s.events.Publish(newEvent(EventStatus, j))
     s.mu.Unlock()
 }
-func (s *JobStore) Get(id string) (*Job, bool) {
+func (s *MemoryStore) CreateUnique(j *Job, dedupe bool) (Job, bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if existing, found, err := s.duplicate(j, dedupe); found || err != nil {
+        return existing, false, err
+    }
+    s.jobs[j.ID] = j
+    s.index.add(j)
+    s.saved(j)
+    s.events.Publish(newEvent(EventStatus, j))
+    return *j, true, nil
+}
+func (s *MemoryStore) FindDuplicate(j *Job, dedupe bool) (Job, bool, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.duplicate(j, dedupe)
+}
+
+// duplicate looks up the job serving j; the caller holds the lock
+func (s *MemoryStore) duplicate(j *Job, dedupe bool) (Job, bool, error) {
+    if existing, ok := s.index.byIdempotencyKey(j); ok {
+        if existing.Fingerprint != j.Fingerprint {
+            return Job{}, false, ErrIdempotencyKeyReused
+        }
+        return *existing, true, nil
+    }
+    if dedupe {
+        if existing, ok := s.index.byOutput(j.Fingerprint); ok {
+            return *existing, true, nil
+        }
+    }
+    return Job{}, false, nil
+}
+func (s *MemoryStore) Get(id string) (*Job, bool) {
     s.mu.RLock()
     defer s.mu.RUnlock()
     j, ok := s.jobs[id]
     return j, ok
 }
-func (s *JobStore) SetStatus(id string, st JobStatus, err error) {
+func (s *MemoryStore) Snapshot(id string) (Job, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    j, ok := s.jobs[id]
+    if !ok {
+        return Job{}, false
+    }
+    return *j, true
+}
+func (s *MemoryStore) List(match func(j *Job) bool) []Job {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    var list []Job
+    for _, j := range s.jobs {
+        if match(j) {
+            list = append(list, *j)
+        }
+    }
+    return list
+}
+func (s *MemoryStore) Query(q JobQuery) (JobPage, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.index.query(q)
+}
+func (s *MemoryStore) Start(id string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    j, ok := s.jobs[id]
+    if !ok || j.Status != StatusQueued {
+        return false
+    }
+    j.Status = StatusInProgress
+    j.UpdatedAt = time.Now()
+    s.index.statusChanged(j, StatusQueued)
+    s.saved(j)
+    s.events.Publish(newEvent(EventStatus, j))
+    return true
+}
+func (s *MemoryStore) Requeue(id string, fn func(j *Job)) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    j, ok := s.jobs[id]
+    if !ok || j.Status != StatusFailed {
+        return false
+    }
+    fn(j)
+    j.Status = StatusQueued
+    j.UpdatedAt = time.Now()
+    s.index.statusChanged(j, StatusFailed)
+    s.saved(j)
+    s.events.Publish(newEvent(EventStatus, j))
+    return true
+}
+func (s *MemoryStore) Update(id string, fn func(j *Job)) {
     s.mu.Lock()
     if j, ok := s.jobs[id]; ok {
+        old := j.Status
+        fn(j)
+        j.UpdatedAt = time.Now()
+        s.index.statusChanged(j, old)
+        s.saved(j)
+    }
+    s.mu.Unlock()
+}
+func (s *MemoryStore) SetStatus(id string, st JobStatus, err error) {
+    s.mu.Lock()
+    if j, ok := s.jobs[id]; ok && j.Status != StatusCancelled {
+        old := j.Status
         j.Status = st
         if err != nil {
             j.Error = err.Error()
         }
         j.UpdatedAt = time.Now()
+        s.index.statusChanged(j, old)
+        s.saved(j)
+        s.events.Publish(newEvent(EventStatus, j))
     }
     s.mu.Unlock()
 }
+// SetProgress is not saved, as progress is only meaningful while the process
+// that runs the job is alive
+func (s *MemoryStore) SetProgress(id string, p *JobProgress) {
+    s.mu.Lock()
+    if j, ok := s.jobs[id]; ok {
+        j.Progress = p
+        j.UpdatedAt = time.Now()
+        s.events.Publish(newEvent(EventProgress, j))
+    }
+    s.mu.Unlock()
+}
+func (s *MemoryStore) Cancel(id, who string) (Job, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    j, ok := s.jobs[id]
+    if !ok {
+        return Job{}, ErrJobNotFound
+    }
+    if j.Status != StatusQueued && j.Status != StatusInProgress {
+        return Job{}, ErrJobFinished
+    }
+    now := time.Now()
+    old := j.Status
+    j.Status = StatusCancelled
+    s.index.statusChanged(j, old)
+    j.CancelledAt = &now
+    j.CancelledBy = who
+    j.UpdatedAt = now
+    if j.cancel != nil {
+        j.cancel(ErrJobCancelled)
+    }
+    s.saved(j)
+    s.events.Publish(newEvent(EventStatus, j))
+    return *j, nil
+}
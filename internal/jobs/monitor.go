@@ -0,0 +1,239 @@
+package jobs
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"csv-email-flagger/pkg/logger"
+)
+
+const (
+	// wsPingInterval is how often the server pings a monitoring client
+	wsPingInterval = 30 * time.Second
+	// wsPongWait is how long a client may stay silent before it is dropped
+	wsPongWait = 2 * wsPingInterval
+	// wsWriteWait bounds a single write to a client
+	wsWriteWait = 10 * time.Second
+	// wsBuffer is the number of events held for a client before it lags
+	wsBuffer = 256
+)
+
+// MonitorRequest is a message from a monitoring client. Subscribe adds job IDs
+// and tags to the watched set and unsubscribe removes them. LastSeq, when set
+// on subscribe, replays the matching events published after it.
+type MonitorRequest struct {
+	Type    string   `json:"type"`
+	JobIDs  []string `json:"job_ids,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	LastSeq uint64   `json:"last_seq,omitempty"`
+}
+
+// MonitorMessage is sent to monitoring clients. Event messages carry a
+// published event, snapshot messages the current state of a job when events
+// cannot be replayed, and error messages reject a request.
+type MonitorMessage struct {
+	Type  string `json:"type"`
+	Event *Event `json:"event,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// watchSet is the job IDs and tags a client follows. The hub reads it from
+// publishing goroutines while the client's requests change it.
+type watchSet struct {
+	mu   sync.RWMutex
+	ids  map[string]bool
+	tags map[string]bool
+}
+
+func (w *watchSet) update(req MonitorRequest, add bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, id := range req.JobIDs {
+		w.ids[id] = add
+	}
+	for _, tag := range req.Tags {
+		w.tags[tag] = add
+	}
+}
+
+func (w *watchSet) matches(id string, tags []string) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.ids[id] {
+		return true
+	}
+	for _, tag := range tags {
+		if w.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *watchSet) matchEvent(e Event) bool {
+	return w.matches(e.JobID, e.Tags)
+}
+
+var upgrader = websocket.Upgrader{CheckOrigin: checkOrigin}
+
+// checkOrigin accepts same-origin requests and the origins listed in
+// WS_ALLOWED_ORIGINS, where "*" allows any
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// ServeMonitor upgrades the request to a WebSocket that streams the status and
+// progress events of the jobs a client subscribes to. The initial subscription
+// can also be given as job_id, tag and last_seq query parameters, so a client
+// reconnects by repeating its URL with the last sequence number it saw.
+func ServeMonitor(w http.ResponseWriter, r *http.Request) {
+	initial := MonitorRequest{Type: "subscribe", JobIDs: r.URL.Query()["job_id"], Tags: r.URL.Query()["tag"]}
+	if v := r.URL.Query().Get("last_seq"); v != "" {
+		seq, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "last_seq must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		initial.LastSeq = seq
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied
+		return
+	}
+	defer conn.Close()
+
+	watch := &watchSet{ids: make(map[string]bool), tags: make(map[string]bool)}
+	sub := Events.Subscribe(watch.matchEvent, wsBuffer)
+	defer Events.Unsubscribe(sub)
+
+	// Requests are read on their own goroutine and applied by the writer, so
+	// replays and live events go out in order
+	requests := make(chan MonitorRequest)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			var req MonitorRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			select {
+			case requests <- req:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	m := &monitor{conn: conn, watch: watch, sub: sub}
+	if len(initial.JobIDs) > 0 || len(initial.Tags) > 0 {
+		if err := m.apply(initial); err != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case req := <-requests:
+			err = m.apply(req)
+		case e := <-sub.C:
+			err = m.sendEvent(e)
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+		case <-closed:
+			return
+		}
+		// Catch up with a snapshot after dropped events
+		if err == nil && sub.Lagged() {
+			err = m.snapshots()
+		}
+		if err != nil {
+			logger.Log.WithError(err).Debug("monitoring client disconnected")
+			return
+		}
+	}
+}
+
+// monitor is the writing side of a monitoring connection
+type monitor struct {
+	conn     *websocket.Conn
+	watch    *watchSet
+	sub      *Subscription
+	lastSent uint64
+}
+
+func (m *monitor) write(msg MonitorMessage) error {
+	m.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return m.conn.WriteJSON(msg)
+}
+
+// sendEvent forwards a live event unless a replay already covered it
+func (m *monitor) sendEvent(e Event) error {
+	if e.Seq <= m.lastSent {
+		return nil
+	}
+	m.lastSent = e.Seq
+	return m.write(MonitorMessage{Type: "event", Event: &e})
+}
+
+// snapshots sends the current state of every watched job
+func (m *monitor) snapshots() error {
+	jobs := Jobs.List(func(j *Job) bool { return m.watch.matches(j.ID, j.Tags) })
+	slices.SortFunc(jobs, func(a, b Job) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	for i := range jobs {
+		e := newEvent(EventStatus, &jobs[i])
+		if err := m.write(MonitorMessage{Type: "snapshot", Event: &e}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *monitor) apply(req MonitorRequest) error {
+	switch req.Type {
+	case "subscribe":
+		m.watch.update(req, true)
+		if req.LastSeq > 0 {
+			if events, ok := Events.Since(req.LastSeq, m.watch.matchEvent); ok {
+				for _, e := range events {
+					if err := m.sendEvent(e); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+		return m.snapshots()
+	case "unsubscribe":
+		m.watch.update(req, false)
+		return nil
+	}
+	return m.write(MonitorMessage{Type: "error", Error: "unknown request type " + strconv.Quote(req.Type)})
+}
@@ -0,0 +1,142 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"csv-email-flagger/internal/transform"
+)
+
+// applyUploadOptions validates the optional form fields of an upload and records
+// them on the job
+func applyUploadOptions(r *http.Request, filename string, j *Job) error {
+	var err error
+
+	// Browsers on Windows may send the full client path
+	j.Filename = filepath.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if j.Filename == "." || j.Filename == "/" {
+		j.Filename = ""
+	}
+
+	j.InputFormat = transform.FormatFromFilename(filename)
+	if v := r.FormValue("input_format"); v != "" {
+		if j.InputFormat, err = transform.ParseFormat(v); err != nil {
+			return err
+		}
+	}
+	if j.InputFormat == transform.FormatParquet {
+		return errors.New("parquet is only supported as an output format")
+	}
+
+	j.OutputFormat = transform.FormatCSV
+	if v := r.FormValue("output_format"); v != "" {
+		if j.OutputFormat, err = transform.ParseFormat(v); err != nil {
+			return err
+		}
+	}
+	if v := r.FormValue("row_group_size"); v != "" {
+		if j.RowGroupSize, err = strconv.Atoi(v); err != nil || j.RowGroupSize <= 0 {
+			return errors.New("row_group_size must be a positive integer")
+		}
+	}
+
+	if v := r.FormValue("lenient"); v != "" {
+		if j.Lenient, err = strconv.ParseBool(v); err != nil {
+			return errors.New("lenient must be true or false")
+		}
+	}
+	if v := r.FormValue("max_errors"); v != "" {
+		if j.MaxErrors, err = strconv.Atoi(v); err != nil || j.MaxErrors < 0 {
+			return errors.New("max_errors must be a non-negative integer")
+		}
+	}
+	if v := r.FormValue("max_error_ratio"); v != "" {
+		if j.MaxErrorRatio, err = strconv.ParseFloat(v, 64); err != nil || j.MaxErrorRatio < 0 || j.MaxErrorRatio > 1 {
+			return errors.New("max_error_ratio must be between 0 and 1")
+		}
+	}
+
+	if v := r.FormValue("pad_short_rows"); v != "" {
+		if j.PadShortRows, err = strconv.ParseBool(v); err != nil {
+			return errors.New("pad_short_rows must be true or false")
+		}
+	}
+	if v := r.FormValue("long_rows"); v != "" {
+		if j.LongRows, err = transform.ParseLongRowPolicy(v); err != nil {
+			return err
+		}
+	}
+
+	j.Client = ClientID(r)
+	j.Priority = PriorityNormal
+	if v := r.FormValue("priority"); v != "" {
+		if j.Priority, err = ParsePriority(v); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			j.Tags = append(j.Tags, tag)
+		}
+	}
+
+	if j.Labels, err = parseLabels(r.FormValue("labels")); err != nil {
+		return err
+	}
+	if v := r.FormValue("metadata"); v != "" {
+		if len(v) > MaxMetadataBytes {
+			return fmt.Errorf("metadata must not exceed %d bytes", MaxMetadataBytes)
+		}
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(v), &obj); err != nil || obj == nil {
+			return errors.New("metadata must be a JSON object")
+		}
+		j.Metadata = json.RawMessage(v)
+	}
+
+	if v := r.FormValue("callback_url"); v != "" {
+		if j.Webhook, err = newWebhook(r, v); err != nil {
+			return err
+		}
+	}
+
+	if v := r.FormValue("domain_report"); v != "" {
+		if j.DomainReport, err = strconv.ParseBool(v); err != nil {
+			return errors.New("domain_report must be true or false")
+		}
+	}
+	return nil
+}
+
+// MaxMetadataBytes caps the metadata stored with a job
+const MaxMetadataBytes = 8 << 10
+
+// parseLabels reads comma-separated key=value labels. Keys may not be empty or
+// repeated.
+func parseLabels(s string) (map[string]string, error) {
+	var labels map[string]string
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(entry, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("label %q must be key=value", entry)
+		}
+		if _, dup := labels[k]; dup {
+			return nil, fmt.Errorf("label %q is given twice", k)
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Priority orders the waiting jobs of a client
+type Priority string
+
+const (
+	PriorityLow    Priority = "low"
+	PriorityNormal Priority = "normal"
+	PriorityHigh   Priority = "high"
+)
+
+// ParsePriority validates the priority option of an upload
+func ParsePriority(s string) (Priority, error) {
+	switch p := Priority(strings.ToLower(strings.TrimSpace(s))); p {
+	case PriorityLow, PriorityNormal, PriorityHigh:
+		return p, nil
+	}
+	return "", fmt.Errorf("unsupported priority %q", s)
+}
+
+// rank is higher for jobs that should run first. Jobs recorded without a
+// priority count as normal.
+func (p Priority) rank() int {
+	switch p {
+	case PriorityLow:
+		return 0
+	case PriorityHigh:
+		return 2
+	}
+	return 1
+}
+
+// ClientID identifies the client behind a request by its X-User header, falling
+// back to the client address
+func ClientID(r *http.Request) string {
+	if who := r.Header.Get("X-User"); who != "" {
+		return who
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
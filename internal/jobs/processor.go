@@ -1,10 +1,15 @@
 package jobs
 
 import (
+	"context"
 	"errors"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"csv-email-flagger/internal/storage"
@@ -15,54 +20,161 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// CreateAndQueue handles file upload, saves it, creates job, and spawns processing goroutine
-func CreateAndQueue(r *http.Request) (string, string, error) {
+// CreateAndQueue handles file upload, saves it, creates job, and queues it for
+// processing. It returns ErrQueueFull when no more jobs may wait. An upload
+// that repeats an Idempotency-Key, or asks to be deduplicated against an
+// earlier one, is discarded and the job that serves it is returned instead,
+// with created false.
+func CreateAndQueue(r *http.Request) (Job, bool, error) {
 	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		return "", "", err
+		return Job{}, false, err
 	}
-	file, _, err := r.FormFile("file")
+	file, header, err := r.FormFile("file")
 	if err != nil {
-		return "", "", errors.New("missing file")
+		return Job{}, false, errors.New("missing file")
 	}
 	defer file.Close()
 
-	id := uuid.NewString()
-	inPath, err := storage.SaveUpload(file, id)
+	j, err := newJob(r, header.Filename, header.Size)
 	if err != nil {
-		return "", "", err
+		return Job{}, false, err
+	}
+	if j.IdempotencyKey, err = idempotencyKey(r); err != nil {
+		return Job{}, false, err
+	}
+	dedupe, err := dedupeRequested(r)
+	if err != nil {
+		return Job{}, false, err
+	}
+
+	// The upload is hashed as it is stored, and a retry or duplicate is then
+	// answered before it claims a place in the queue
+	if err := j.saveUpload(file); err != nil {
+		return Job{}, false, err
+	}
+	if j.IdempotencyKey != "" || dedupe {
+		if existing, found, err := Jobs.FindDuplicate(j, dedupe); found || err != nil {
+			os.Remove(j.InputPath)
+			if err == nil {
+				err = checkCallback(existing, j)
+			}
+			return existing, false, err
+		}
+	}
+	if err := queue.reserve(); err != nil {
+		os.Remove(j.InputPath)
+		return Job{}, false, err
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	j.cancel = cancel
+	snap, created, err := Jobs.CreateUnique(j, dedupe)
+	if !created {
+		// Another upload of the same file got in first
+		cancel(nil)
+		queue.release()
+		os.Remove(j.InputPath)
+		if err == nil {
+			err = checkCallback(snap, j)
+		}
+		return snap, false, err
+	}
+	queue.push(ctx, j, true)
+
+	return snap, true, nil
+}
+
+// newJob validates the upload options of r for a file and returns a queued job
+// to process it
+func newJob(r *http.Request, filename string, size int64) (*Job, error) {
+	j := &Job{ID: uuid.NewString(), Status: StatusQueued}
+	if err := applyUploadOptions(r, filename, j); err != nil {
+		return nil, err
 	}
 
 	mode := os.Getenv("PROCESS_MODE")
 	if mode == "" {
 		mode = "sequential"
 	}
-
-	j := &Job{
-		ID:        id,
-		Status:    StatusQueued,
-		InputPath: inPath,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		Mode:      mode,
+	var err error
+	if j.Mode, j.Workers, err = resolveWorkers(r.FormValue("workers"), mode, size); err != nil {
+		return nil, err
 	}
-	Jobs.Create(j)
+	return j, nil
+}
 
-	// process in background
-	go processJob(j)
+// saveUpload stores the upload of j from content and records its details
+func (j *Job) saveUpload(content io.Reader) error {
+	upload, err := storage.SaveUpload(content, j.ID)
+	if err != nil {
+		return err
+	}
+	j.InputPath = upload.Path
+	j.Size = upload.Size
+	j.SHA256 = upload.SHA256
+	j.Fingerprint = fingerprint(j)
+	j.CreatedAt = time.Now()
+	j.UpdatedAt = j.CreatedAt
+	return nil
+}
 
-	return id, mode, nil
+// ResumeInterrupted queues the jobs loaded by OpenFileStore in QUEUED, oldest
+// first, regardless of MAX_QUEUED_JOBS. It returns the number of jobs queued.
+func ResumeInterrupted() int {
+	queued := Jobs.List(func(j *Job) bool { return j.Status == StatusQueued })
+	slices.SortFunc(queued, func(a, b Job) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	for _, q := range queued {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		var j *Job
+		Jobs.Update(q.ID, func(job *Job) {
+			job.cancel = cancel
+			j = job
+		})
+		queue.push(ctx, j, false)
+	}
+	return len(queued)
 }
 
-func processJob(j *Job) {
-	log := logger.Log.WithFields(logrus.Fields{"job_id": j.ID, "mode": j.Mode})
-	Jobs.SetStatus(j.ID, StatusInProgress, nil)
+func processJob(ctx context.Context, j *Job) {
+	log := logger.Log.WithFields(logrus.Fields{"job_id": j.ID, "mode": j.Mode, "workers": j.Workers})
+
+	// A job cancelled while queued never starts
+	started := Jobs.Start(j.ID)
+	// Cancelled jobs leave nothing behind, and finished jobs notify their
+	// callback URL. Registered first so that it runs after every file below has
+	// been closed.
+	defer func() {
+		if errors.Is(context.Cause(ctx), ErrJobCancelled) {
+			if err := storage.CleanupJobFiles(j.ID); err != nil {
+				log.WithError(err).Warn("failed to clean up cancelled job")
+			}
+			log.Info("job cancelled")
+			return
+		}
+		if snap, ok := Jobs.Snapshot(j.ID); ok && snap.Webhook != nil && snap.Status.Terminal() {
+			startWebhook(j.ID)
+		}
+	}()
+	if !started {
+		return
+	}
+
+	attempt := Attempt{StartedAt: time.Now()}
+	err := runJob(ctx, j, log)
+	if errors.Is(context.Cause(ctx), ErrJobCancelled) {
+		return
+	}
+	finishAttempt(ctx, j, attempt, err, log)
+}
 
+// runJob transforms the upload of a started job and marks it done. Failures
+// are returned for processJob to record.
+func runJob(ctx context.Context, j *Job, log *logrus.Entry) error {
 	// Open input file
 	in, err := os.Open(j.InputPath)
 	if err != nil {
-		Jobs.SetStatus(j.ID, StatusFailed, err)
 		log.WithError(err).Error("failed to open input file")
-		return
+		return err
 	}
 	defer func() {
 		if closeErr := in.Close(); closeErr != nil {
@@ -70,13 +182,13 @@ func processJob(j *Job) {
 		}
 	}()
 
-	// Create output file
-	outPath := storage.GetProcessedFilePath(j.ID)
-	out, err := os.Create(outPath)
+	// Create output file, or pick up from the last checkpoint
+	stored := storedFormat(j)
+	outPath := storage.GetOutputFilePath(j.ID, stored.Extension())
+	out, resume, err := openOutput(j, in, outPath, log)
 	if err != nil {
-		Jobs.SetStatus(j.ID, StatusFailed, err)
 		log.WithError(err).Error("failed to create output file")
-		return
+		return err
 	}
 	defer func() {
 		if closeErr := out.Close(); closeErr != nil {
@@ -84,27 +196,129 @@ func processJob(j *Job) {
 		}
 	}()
 
-	// Process depending on mode
-	if j.Mode == "parallel" {
-		err = transform.TransformParallel(in, out, 4)
+	stats := &transform.Stats{}
+	opts := transform.Options{
+		Lenient:       j.Lenient,
+		MaxErrors:     j.MaxErrors,
+		MaxErrorRatio: j.MaxErrorRatio,
+		PadShortRows:  j.PadShortRows,
+		LongRows:      j.LongRows,
+		Stats:         stats,
+		Resume:        resume,
+	}
+	if info, statErr := in.Stat(); statErr == nil {
+		opts.Progress = progressReporter(j.ID, info.Size(), time.Now(), resume)
+	}
+	if resumable(j) {
+		opts.Checkpoint = checkpointRecorder(j.ID, out, log)
+		opts.CheckpointInterval = checkpointInterval()
+	}
+	if j.DomainReport {
+		opts.Domains = transform.NewDomainReport(transform.DefaultDomainReportCapacity)
+	}
+	// Malformed rows skipped in lenient mode and rows rejected for their width
+	// are kept in a quarantine CSV
+	quarantinePath := storage.GetQuarantineFilePath(j.ID)
+	if j.Lenient || j.LongRows == transform.LongRowsReject {
+		qf, err := os.Create(quarantinePath)
+		if err != nil {
+			log.WithError(err).Error("failed to create quarantine file")
+			return err
+		}
+		defer func() {
+			if closeErr := qf.Close(); closeErr != nil {
+				log.WithError(closeErr).Warn("failed to close quarantine file")
+			}
+		}()
+		opts.Quarantine = transform.NewQuarantine(qf)
+	}
+
+	// JOB_TIMEOUT bounds how long a single transform may run
+	if timeout, parseErr := time.ParseDuration(os.Getenv("JOB_TIMEOUT")); parseErr == nil && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// JSON output is written directly, so JSON input keeps its value types.
+	// Other formats are stored as CSV and converted on download.
+	newReader, newWriter := transform.NewReader, transform.NewWriter
+	if j.InputFormat.IsJSON() && stored.IsJSON() {
+		newReader, newWriter = transform.NewRawReader, transform.NewRawWriter
+		opts.RawJSON = true
+	}
+	rw, err := newWriter(stored, out)
+	if err != nil {
+		return err
+	}
+	isCSV := j.InputFormat == transform.FormatCSV || j.InputFormat == ""
+	if j.Mode == "chunked" && isCSV {
+		// Falls back to streaming when the input cannot be split
+		err = transform.TransformChunkedContext(ctx, in, rw, j.Workers, opts)
 	} else {
-		err = transform.TransformSequential(in, out)
+		var rr transform.RecordReader
+		rr, err = newReader(j.InputFormat, in)
+		if err == nil {
+			// Process depending on mode
+			if j.Mode == "parallel" || j.Mode == "chunked" {
+				err = transform.TransformParallelContext(ctx, rr, rw, j.Workers, opts)
+			} else {
+				err = transform.TransformSequentialContext(ctx, rr, rw, opts)
+			}
+		}
 	}
 
+	malformed := 0
+	if opts.Quarantine != nil {
+		if closeErr := opts.Quarantine.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		malformed = opts.Quarantine.Count()
+		if malformed == 0 {
+			if removeErr := os.Remove(quarantinePath); removeErr != nil {
+				log.WithError(removeErr).Warn("failed to remove empty quarantine file")
+			}
+		}
+	}
+	Jobs.Update(j.ID, func(j *Job) {
+		j.MalformedRows = malformed
+		j.Stats = stats
+	})
+
+	if errors.Is(context.Cause(ctx), ErrJobCancelled) {
+		return context.Cause(ctx)
+	}
 	if err != nil {
 		// Clean up output file on error
 		if removeErr := os.Remove(outPath); removeErr != nil {
 			log.WithError(removeErr).Warn("failed to remove output file after error")
 		}
-		Jobs.SetStatus(j.ID, StatusFailed, err)
-		log.WithError(err).Error("processing failed")
-		return
+		Jobs.Update(j.ID, func(j *Job) { j.Checkpoint = nil })
+		return err
+	}
+
+	if err := writeStatsReport(j.ID, stats); err != nil {
+		log.WithError(err).Warn("failed to write stats report")
+	}
+	if opts.Domains != nil {
+		if err := writeDomainsReport(j.ID, opts.Domains); err != nil {
+			log.WithError(err).Warn("failed to write domains report")
+		}
 	}
 
 	// Update job with output path and mark as done
-	j.Output = outPath
+	Jobs.Update(j.ID, func(j *Job) {
+		j.Output = outPath
+		j.Checkpoint = nil
+	})
+	if malformed > 0 {
+		Jobs.SetStatus(j.ID, StatusDoneWithErrors, nil)
+		log.WithField("malformed_rows", malformed).Warn("job completed with malformed rows skipped")
+		return nil
+	}
 	Jobs.SetStatus(j.ID, StatusDone, nil)
 	log.Info("job completed successfully")
+	return nil
 }
 
 // Get retrieves job by id
@@ -112,7 +326,29 @@ func Get(id string) (*Job, bool) {
 	return Jobs.Get(id)
 }
 
-// ServeDownload streams the processed file if available
+// Status returns a snapshot of a job with its place in the queue
+func Status(id string) (Job, bool) {
+	j, ok := Jobs.Snapshot(id)
+	if ok && j.Status == StatusQueued {
+		j.QueuePosition = queue.position(id)
+	}
+	return j, ok
+}
+
+// Cancel cancels a job. A job waiting in the queue is taken out of it and its
+// files are cleaned up right away.
+func Cancel(id, who string) (Job, error) {
+	j, err := Jobs.Cancel(id, who)
+	if err == nil {
+		if qj, ok := queue.remove(id); ok {
+			go processJob(qj.ctx, qj.j)
+		}
+	}
+	return j, err
+}
+
+// ServeDownload streams the processed file if available. The job's output format
+// is used unless the Accept header asks for another supported format.
 func ServeDownload(w http.ResponseWriter, r *http.Request, id string) {
 	j, ok := Jobs.Get(id)
 	if !ok {
@@ -120,17 +356,115 @@ func ServeDownload(w http.ResponseWriter, r *http.Request, id string) {
 		return
 	}
 	switch j.Status {
-	case StatusDone:
+	case StatusDone, StatusDoneWithErrors:
 		f, err := os.Open(j.Output)
 		if err != nil {
 			http.Error(w, "invalid id", http.StatusBadRequest)
 			return
 		}
 		defer f.Close()
-		w.Header().Set("Content-Type", "text/csv")
-		http.ServeContent(w, r, filepath.Base(j.Output), time.Now(), f)
+
+		format := j.OutputFormat
+		if accepted, ok := transform.FormatFromAccept(r.Header.Get("Accept")); ok {
+			format = accepted
+		}
+		if format == "" {
+			format = transform.FormatCSV
+		}
+		setAttachment(w, downloadName(j, ".flagged"+format.Extension()))
+		w.Header().Set("Content-Type", format.ContentType())
+		stored := transform.FormatFromFilename(j.Output)
+		if format == stored {
+			http.ServeContent(w, r, filepath.Base(j.Output), time.Now(), f)
+			return
+		}
+		if err := convertOutput(w, f, stored, format, j.RowGroupSize); err != nil {
+			logger.Log.WithError(err).WithField("job_id", id).Error("failed to convert download")
+		}
 	case StatusFailed:
 		http.Error(w, "invalid id", http.StatusBadRequest)
+	case StatusCancelled:
+		http.Error(w, ErrJobCancelled.Error(), http.StatusGone)
+	default:
+		http.Error(w, "job in progress", http.StatusLocked)
+	}
+}
+
+// storedFormat is the format the output of j is written in. JSON outputs are
+// written as requested; the others are stored as CSV and converted on download.
+func storedFormat(j *Job) transform.Format {
+	if j.OutputFormat.IsJSON() {
+		return j.OutputFormat
+	}
+	return transform.FormatCSV
+}
+
+// convertOutput converts the stored output of a job from one format to
+// another. Values keep their JSON types between the JSON formats.
+func convertOutput(w io.Writer, f io.Reader, from, to transform.Format, rowGroupSize int) error {
+	newReader := transform.NewReader
+	var rw transform.RecordWriter
+	var err error
+	if from.IsJSON() && to.IsJSON() {
+		newReader = transform.NewRawReader
+		rw, err = transform.NewRawWriter(to, w)
+	} else {
+		rw, err = outputWriter(w, to, rowGroupSize)
+	}
+	if err != nil {
+		return err
+	}
+	rr, err := newReader(from, f)
+	if err != nil {
+		return err
+	}
+	return transform.Convert(rr, rw)
+}
+
+// outputWriter returns a writer encoding the output of a job to format
+func outputWriter(w io.Writer, format transform.Format, rowGroupSize int) (transform.RecordWriter, error) {
+	if format == transform.FormatParquet {
+		return transform.NewParquetWriter(w, rowGroupSize), nil
+	}
+	return transform.NewWriter(format, w)
+}
+
+// downloadName names a file served for j after its original upload, with the
+// extension replaced by suffix. Jobs uploaded without a filename use their ID.
+func downloadName(j *Job, suffix string) string {
+	name := strings.TrimSuffix(j.Filename, filepath.Ext(j.Filename))
+	if name == "" {
+		name = j.ID
+	}
+	return name + suffix
+}
+
+func setAttachment(w http.ResponseWriter, filename string) {
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+}
+
+// ServeQuarantine streams the malformed rows skipped by a lenient job
+func ServeQuarantine(w http.ResponseWriter, r *http.Request, id string) {
+	j, ok := Jobs.Get(id)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	switch j.Status {
+	case StatusDoneWithErrors, StatusFailed:
+		f, err := os.Open(storage.GetQuarantineFilePath(id))
+		if err != nil {
+			http.Error(w, "no quarantined rows", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "text/csv")
+		setAttachment(w, downloadName(j, storage.QuarantineSuffix))
+		http.ServeContent(w, r, filepath.Base(f.Name()), time.Now(), f)
+	case StatusDone:
+		http.Error(w, "no quarantined rows", http.StatusNotFound)
+	case StatusCancelled:
+		http.Error(w, ErrJobCancelled.Error(), http.StatusGone)
 	default:
 		http.Error(w, "job in progress", http.StatusLocked)
 	}
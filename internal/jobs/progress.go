@@ -0,0 +1,51 @@
+package jobs
+
+import (
+	"time"
+
+	"csv-email-flagger/internal/transform"
+)
+
+// JobProgress is how far a job has got through its upload. Percent and the ETA
+// are estimated from the bytes consumed against the upload size.
+type JobProgress struct {
+	BytesRead      int64   `json:"bytes_read"`
+	TotalBytes     int64   `json:"total_bytes"`
+	RowsProcessed  int64   `json:"rows_processed"`
+	Percent        float64 `json:"percent"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	RowsPerSecond  float64 `json:"rows_per_second"`
+	ETASeconds     float64 `json:"eta_seconds"`
+}
+
+// progressReporter returns a transform progress callback that updates the job
+// with id, whose upload is total bytes and started processing at start, from
+// the checkpoint resume if it is not nil
+func progressReporter(id string, total int64, start time.Time, resume *transform.Checkpoint) func(transform.Progress) {
+	var from transform.Checkpoint
+	if resume != nil {
+		from = *resume
+	}
+	Jobs.SetProgress(id, &JobProgress{TotalBytes: total})
+	return func(p transform.Progress) {
+		jp := &JobProgress{
+			BytesRead:     p.BytesRead,
+			TotalBytes:    total,
+			RowsProcessed: p.Rows,
+		}
+		if p.Done {
+			jp.BytesRead = total
+		}
+		if total > 0 {
+			jp.Percent = min(100, float64(jp.BytesRead)*100/float64(total))
+		}
+		if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+			jp.BytesPerSecond = float64(jp.BytesRead-from.InputOffset) / elapsed
+			jp.RowsPerSecond = float64(jp.RowsProcessed-from.Rows) / elapsed
+		}
+		if jp.BytesPerSecond > 0 && jp.BytesRead < total {
+			jp.ETASeconds = float64(total-jp.BytesRead) / jp.BytesPerSecond
+		}
+		Jobs.SetProgress(id, jp)
+	}
+}
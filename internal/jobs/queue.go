@@ -0,0 +1,211 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultConcurrentJobs is the number of jobs processed at once unless
+	// MAX_CONCURRENT_JOBS says otherwise
+	DefaultConcurrentJobs = 4
+	// DefaultQueuedJobs is the number of jobs that may wait for a slot unless
+	// MAX_QUEUED_JOBS says otherwise
+	DefaultQueuedJobs = 100
+)
+
+// ErrQueueFull rejects an upload while MAX_QUEUED_JOBS jobs are waiting
+var ErrQueueFull = errors.New("job queue is full")
+
+type queuedJob struct {
+	ctx context.Context
+	j   *Job
+}
+
+// jobQueue runs jobs on a bounded number of slots. Jobs wait in QUEUED until a
+// slot frees up. Clients below their own concurrency limit take turns, and
+// each client's jobs start by priority, then oldest first, so a client with
+// many uploads, even high priority ones, cannot starve the others.
+type jobQueue struct {
+	mu       sync.Mutex
+	pending  []queuedJob // in arrival order
+	reserved int         // uploads accepted but not yet pushed
+	running  int
+	byClient map[string]int    // running jobs per client
+	served   map[string]uint64 // when each client last had a job started
+	turn     uint64
+}
+
+var queue = &jobQueue{byClient: make(map[string]int), served: make(map[string]uint64)}
+
+func envLimit(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// clientLimits returns the running jobs allowed per client: the entries of
+// CLIENT_JOB_LIMITS ("alice=4,bob=1") or else MAX_JOBS_PER_CLIENT, where 0
+// means no limit beyond MAX_CONCURRENT_JOBS
+func clientLimits() func(client string) int {
+	def := envLimit("MAX_JOBS_PER_CLIENT", 0)
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(os.Getenv("CLIENT_JOB_LIMITS"), ",") {
+		client, v, ok := strings.Cut(entry, "=")
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); ok && err == nil && n > 0 {
+			limits[strings.TrimSpace(client)] = n
+		}
+	}
+	return func(client string) int {
+		if n, ok := limits[client]; ok {
+			return n
+		}
+		return def
+	}
+}
+
+// reserve claims a place in the queue before an upload is stored. The place is
+// given back by push or release.
+func (q *jobQueue) reserve() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending)+q.reserved >= envLimit("MAX_QUEUED_JOBS", DefaultQueuedJobs) {
+		return ErrQueueFull
+	}
+	q.reserved++
+	return nil
+}
+
+func (q *jobQueue) release() {
+	q.mu.Lock()
+	q.reserved--
+	q.mu.Unlock()
+}
+
+// push queues a job for a reserved place, or without one when reserved is
+// false, as for jobs resumed after a restart
+func (q *jobQueue) push(ctx context.Context, j *Job, reserved bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if reserved {
+		q.reserved--
+	}
+	q.pending = append(q.pending, queuedJob{ctx: ctx, j: j})
+	q.dispatch()
+}
+
+// remove takes a job out of the queue. It returns false if the job is not
+// waiting.
+func (q *jobQueue) remove(id string) (queuedJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.IndexFunc(q.pending, func(qj queuedJob) bool { return qj.j.ID == id })
+	if i < 0 {
+		return queuedJob{}, false
+	}
+	qj := q.pending[i]
+	q.pending = slices.Delete(q.pending, i, i+1)
+	q.forget(qj.j.Client)
+	return qj, true
+}
+
+// position is the 1-based place of a job in the order the waiting jobs would
+// start if slots freed up one at a time, or 0 if it is not waiting
+func (q *jobQueue) position(id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := slices.Clone(q.pending)
+	served := make(map[string]uint64, len(q.served))
+	for client, turn := range q.served {
+		served[client] = turn
+	}
+	turn := q.turn
+	for n := 1; len(pending) > 0; n++ {
+		i := next(pending, served, nil)
+		if pending[i].j.ID == id {
+			return n
+		}
+		turn++
+		served[pending[i].j.Client] = turn
+		pending = slices.Delete(pending, i, i+1)
+	}
+	return 0
+}
+
+// next picks the index of the job to start: a job of the client served
+// longest ago, and of that client the highest priority, then the oldest job.
+// Clients never served yet go by priority too. Clients rejected by eligible
+// are skipped. It returns -1 if no job may start.
+func next(pending []queuedJob, served map[string]uint64, eligible func(client string) bool) int {
+	best := -1
+	for i, qj := range pending {
+		if eligible != nil && !eligible(qj.j.Client) {
+			continue
+		}
+		if best < 0 {
+			best = i
+			continue
+		}
+		b := pending[best].j
+		if s, bs := served[qj.j.Client], served[b.Client]; s != bs {
+			if s < bs {
+				best = i
+			}
+			continue
+		}
+		if qj.j.Priority.rank() > b.Priority.rank() {
+			best = i
+		}
+	}
+	return best
+}
+
+// dispatch starts waiting jobs while MAX_CONCURRENT_JOBS and the client limits
+// allow. Called with the lock held.
+func (q *jobQueue) dispatch() {
+	limit := envLimit("MAX_CONCURRENT_JOBS", DefaultConcurrentJobs)
+	clientLimit := clientLimits()
+	eligible := func(client string) bool {
+		n := clientLimit(client)
+		return n == 0 || q.byClient[client] < n
+	}
+	for q.running < limit {
+		i := next(q.pending, q.served, eligible)
+		if i < 0 {
+			return
+		}
+		qj := q.pending[i]
+		q.pending = slices.Delete(q.pending, i, i+1)
+		client := qj.j.Client
+		q.running++
+		q.byClient[client]++
+		q.turn++
+		q.served[client] = q.turn
+		go func() {
+			defer func() {
+				q.mu.Lock()
+				q.running--
+				q.byClient[client]--
+				q.forget(client)
+				q.dispatch()
+				q.mu.Unlock()
+			}()
+			processJob(qj.ctx, qj.j)
+		}()
+	}
+}
+
+// forget drops the bookkeeping of a client with nothing running or waiting
+func (q *jobQueue) forget(client string) {
+	if q.byClient[client] > 0 || slices.ContainsFunc(q.pending, func(qj queuedJob) bool { return qj.j.Client == client }) {
+		return
+	}
+	delete(q.byClient, client)
+	delete(q.served, client)
+}
@@ -0,0 +1,85 @@
+package jobs
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"csv-email-flagger/internal/storage"
+	"csv-email-flagger/internal/transform"
+)
+
+// statsReport is the document written to the job's stats report file
+type statsReport struct {
+	JobID string           `json:"job_id"`
+	Stats *transform.Stats `json:"stats"`
+}
+
+// writeStatsReport saves the statistics of a finished job next to its output
+func writeStatsReport(id string, stats *transform.Stats) error {
+	f, err := os.Create(storage.GetStatsFilePath(id))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(statsReport{JobID: id, Stats: stats}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeDomainsReport saves the domain aggregation of a finished job
+func writeDomainsReport(id string, report *transform.DomainReport) error {
+	f, err := os.Create(storage.GetDomainsReportPath(id))
+	if err != nil {
+		return err
+	}
+	if err := report.WriteCSV(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ServeDomainsReport streams the domain aggregation report of a finished job
+// that was uploaded with domain_report enabled
+func ServeDomainsReport(w http.ResponseWriter, r *http.Request, id string) {
+	serveReport(w, r, id, storage.GetDomainsReportPath(id), "text/csv")
+}
+
+// ServeStatsReport streams the statistics report of a finished job
+func ServeStatsReport(w http.ResponseWriter, r *http.Request, id string) {
+	serveReport(w, r, id, storage.GetStatsFilePath(id), "application/json")
+}
+
+// serveReport streams a per-job report file once the job has finished
+func serveReport(w http.ResponseWriter, r *http.Request, id, path, contentType string) {
+	j, ok := Jobs.Get(id)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	switch j.Status {
+	case StatusDone, StatusDoneWithErrors:
+		f, err := os.Open(path)
+		if err != nil {
+			http.Error(w, "report not available", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", contentType)
+		setAttachment(w, downloadName(j, strings.TrimPrefix(filepath.Base(path), id)))
+		http.ServeContent(w, r, filepath.Base(path), time.Now(), f)
+	case StatusFailed:
+		http.Error(w, "invalid id", http.StatusBadRequest)
+	case StatusCancelled:
+		http.Error(w, ErrJobCancelled.Error(), http.StatusGone)
+	default:
+		http.Error(w, "job in progress", http.StatusLocked)
+	}
+}
@@ -0,0 +1,149 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxAttempts is the number of runs a job gets for transient
+	// failures unless JOB_MAX_ATTEMPTS says otherwise
+	DefaultMaxAttempts = 3
+	// DefaultRetryBackoff is the delay before the first automatic retry unless
+	// JOB_RETRY_BACKOFF says otherwise. It doubles with every further retry.
+	DefaultRetryBackoff = 5 * time.Second
+)
+
+var (
+	// ErrNotFailed rejects a manual retry of a job that has not failed
+	ErrNotFailed = errors.New("only failed jobs can be retried")
+	// ErrUploadGone rejects a manual retry once the upload has been removed
+	ErrUploadGone = errors.New("upload no longer available")
+)
+
+// Attempt is one run of a job
+type Attempt struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+	Retryable  bool      `json:"retryable,omitempty"`
+	Manual     bool      `json:"manual,omitempty"`
+}
+
+// transientErrnos are the system errors worth running a job again for
+var transientErrnos = []syscall.Errno{
+	syscall.ENOSPC,
+	syscall.EIO,
+	syscall.EAGAIN,
+	syscall.EINTR,
+	syscall.EBUSY,
+	syscall.EMFILE,
+	syscall.ENFILE,
+}
+
+// Retryable reports whether a job that failed with err may succeed when run
+// again, such as after a full disk or an I/O error. Malformed input and
+// exceeded limits fail the same way every time.
+func Retryable(err error) bool {
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// finishAttempt records a run of a job. A retryable failure puts the job back
+// in QUEUED until its backoff has passed, as long as attempts remain since the
+// job was last retried by hand. Any other failure fails the job.
+func finishAttempt(ctx context.Context, j *Job, a Attempt, err error, log *logrus.Entry) {
+	a.FinishedAt = time.Now()
+	if err != nil {
+		a.Error = err.Error()
+		a.Retryable = Retryable(err)
+	}
+	runs := 0
+	Jobs.Update(j.ID, func(j *Job) {
+		a.Manual = j.manual
+		j.manual = false
+		// Clipped so that snapshots taken earlier are left unchanged
+		j.Attempts = append(slices.Clip(j.Attempts), a)
+		for i := len(j.Attempts) - 1; i >= 0; i-- {
+			runs++
+			if j.Attempts[i].Manual {
+				break
+			}
+		}
+	})
+	if err == nil {
+		return
+	}
+
+	maxAttempts := envLimit("JOB_MAX_ATTEMPTS", DefaultMaxAttempts)
+	if !a.Retryable || runs >= maxAttempts {
+		Jobs.SetStatus(j.ID, StatusFailed, err)
+		log.WithError(err).WithField("attempts", runs).Error("processing failed")
+		return
+	}
+
+	backoff := DefaultRetryBackoff
+	if d, parseErr := time.ParseDuration(os.Getenv("JOB_RETRY_BACKOFF")); parseErr == nil && d > 0 {
+		backoff = d
+	}
+	delay := backoff << (runs - 1)
+	at := time.Now().Add(delay)
+	Jobs.Update(j.ID, func(j *Job) { j.RetryAt = &at })
+	Jobs.SetStatus(j.ID, StatusQueued, nil)
+	log.WithError(err).WithField("retry_in", delay.String()).Warn("processing failed, retrying")
+	time.AfterFunc(delay, func() {
+		Jobs.Update(j.ID, func(j *Job) { j.RetryAt = nil })
+		// A job cancelled meanwhile is cleaned up by processJob
+		queue.push(ctx, j, false)
+	})
+}
+
+// Retry runs a failed job again from its stored upload. It takes a place in the
+// queue like a new upload and starts a fresh count of automatic retries.
+func Retry(id string) (Job, error) {
+	snap, ok := Jobs.Snapshot(id)
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	if snap.Status != StatusFailed {
+		return Job{}, ErrNotFailed
+	}
+	if _, err := os.Stat(snap.InputPath); err != nil {
+		return Job{}, ErrUploadGone
+	}
+	if err := queue.reserve(); err != nil {
+		return Job{}, err
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	var j *Job
+	requeued := Jobs.Requeue(id, func(job *Job) {
+		job.cancel = cancel
+		job.manual = true
+		job.Error = ""
+		job.Output = ""
+		job.Stats = nil
+		job.Progress = nil
+		job.Checkpoint = nil
+		job.MalformedRows = 0
+		j = job
+	})
+	if !requeued {
+		queue.release()
+		cancel(nil)
+		return Job{}, ErrNotFailed
+	}
+	queue.push(ctx, j, true)
+	snap, _ = Jobs.Snapshot(id)
+	return snap, nil
+}
@@ -0,0 +1,280 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"csv-email-flagger/internal/transform"
+	"csv-email-flagger/pkg/logger"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader carries the hex HMAC-SHA256 of the webhook body, keyed
+	// with WebhookSecret and prefixed with "sha256="
+	SignatureHeader = "X-Signature-256"
+
+	defaultWebhookAttempts = 5
+	defaultWebhookBackoff  = time.Second
+	webhookTimeout         = 10 * time.Second
+)
+
+// Webhook records the callback registered for a job and every delivery attempt.
+// Remaining counts the attempts left to report the current outcome, so that
+// a delivery cut short by a restart can carry on.
+type Webhook struct {
+	URL       string           `json:"url"`
+	Delivered bool             `json:"delivered"`
+	Remaining int              `json:"remaining_attempts,omitempty"`
+	Attempts  []WebhookAttempt `json:"attempts,omitempty"`
+
+	downloadURL string
+}
+
+// WebhookAttempt is one POST to the callback URL
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// WebhookPayload is the JSON body posted when a job finishes
+type WebhookPayload struct {
+	JobID       string           `json:"job_id"`
+	Status      JobStatus        `json:"status"`
+	Error       string           `json:"error,omitempty"`
+	Stats       *transform.Stats `json:"stats,omitempty"`
+	DownloadURL string           `json:"download_url,omitempty"`
+	FinishedAt  time.Time        `json:"finished_at"`
+}
+
+var (
+	// WebhookSecret keys the webhook signatures. It is set from WEBHOOK_SECRET
+	// at startup, and callbacks are refused while it is empty.
+	WebhookSecret []byte
+	// AllowPrivateCallbacks lets callbacks reach loopback, link-local and
+	// private addresses, which are refused by default
+	AllowPrivateCallbacks bool
+)
+
+var errCallbackAddress = errors.New("callback_url must not point to a loopback, link-local or private address")
+
+// webhookClient checks every address it connects to, so a callback host that
+// later resolves elsewhere, or redirects, cannot reach internal services.
+// Proxies are not used, as they would hide the real address.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: webhookTimeout, Control: checkCallbackDial}).DialContext,
+	},
+}
+
+// newWebhook validates a callback URL given at upload. The download link in the
+// payload is based on PUBLIC_URL, or else on the address the upload came in on.
+func newWebhook(r *http.Request, callback string) (*Webhook, error) {
+	if len(WebhookSecret) == 0 {
+		return nil, errors.New("callback_url is not available: WEBHOOK_SECRET is not set")
+	}
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("callback_url must be an absolute http or https URL")
+	}
+	if err := checkCallbackHost(r.Context(), u.Hostname()); err != nil {
+		return nil, err
+	}
+	base := os.Getenv("PUBLIC_URL")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return &Webhook{URL: u.String(), downloadURL: base}, nil
+}
+
+// checkCallbackHost refuses a callback host resolving to an address that
+// callbacks may not reach
+func checkCallbackHost(ctx context.Context, host string) error {
+	if AllowPrivateCallbacks {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("callback_url host %q cannot be resolved", host)
+	}
+	for _, addr := range addrs {
+		if !callbackAllowed(addr) {
+			return errCallbackAddress
+		}
+	}
+	return nil
+}
+
+// checkCallbackDial is the dialer control of webhookClient
+func checkCallbackDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !AllowPrivateCallbacks && !callbackAllowed(addr) {
+		return fmt.Errorf("%w: %s", errCallbackAddress, addr)
+	}
+	return nil
+}
+
+// callbackAllowed reports whether addr is a public address
+func callbackAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsUnspecified() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast()
+}
+
+// Sign returns the signature header value for body
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookAttempts is the number of attempts a delivery gets
+func webhookAttempts() int {
+	if n, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultWebhookAttempts
+}
+
+// startWebhook reports the outcome of a finished job to its callback URL in
+// the background, with a fresh count of attempts
+func startWebhook(id string) {
+	Jobs.Update(id, func(j *Job) {
+		// Copied so that snapshots taken earlier are left unchanged
+		w := *j.Webhook
+		w.Delivered = false
+		w.Remaining = webhookAttempts()
+		j.Webhook = &w
+	})
+	go deliverWebhook(id)
+}
+
+// ResumeWebhooks carries on the deliveries of finished jobs loaded by
+// OpenFileStore that still had attempts left when the server stopped. It
+// returns the number of deliveries resumed.
+func ResumeWebhooks() int {
+	pending := Jobs.List(func(j *Job) bool {
+		return j.Webhook != nil && j.Webhook.Remaining > 0 && j.Status.Terminal() && j.Status != StatusCancelled
+	})
+	for _, j := range pending {
+		go deliverWebhook(j.ID)
+	}
+	return len(pending)
+}
+
+// deliverWebhook posts the outcome of a finished job to its callback URL,
+// retrying failures with exponential backoff until its remaining attempts are
+// used up. WEBHOOK_MAX_ATTEMPTS and WEBHOOK_BACKOFF override the number of
+// attempts and the first delay.
+func deliverWebhook(id string) {
+	j, ok := Jobs.Snapshot(id)
+	if !ok || j.Webhook == nil {
+		return
+	}
+	log := logger.Log.WithFields(logrus.Fields{"job_id": id, "callback_url": j.Webhook.URL})
+
+	payload := WebhookPayload{
+		JobID:      j.ID,
+		Status:     j.Status,
+		Error:      j.Error,
+		Stats:      j.Stats,
+		FinishedAt: j.UpdatedAt,
+	}
+	if j.Status == StatusDone || j.Status == StatusDoneWithErrors {
+		payload.DownloadURL = j.Webhook.downloadURL + "/api/download/" + j.ID
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.WithError(err).Error("failed to encode webhook payload")
+		return
+	}
+	signature := Sign(WebhookSecret, body)
+
+	backoff := defaultWebhookBackoff
+	if d, err := time.ParseDuration(os.Getenv("WEBHOOK_BACKOFF")); err == nil && d > 0 {
+		backoff = d
+	}
+
+	// A resumed delivery waits as long as it would have before its next attempt
+	made := max(webhookAttempts()-j.Webhook.Remaining, 0)
+	for remaining := j.Webhook.Remaining; remaining > 0; remaining-- {
+		if made > 0 {
+			time.Sleep(backoff << (made - 1))
+		}
+		made++
+		attempt := WebhookAttempt{At: time.Now()}
+		code, err := postWebhook(j.Webhook.URL, body, signature, id)
+		attempt.StatusCode = code
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		delivered := err == nil
+		Jobs.Update(id, func(j *Job) {
+			w := *j.Webhook
+			w.Attempts = append(slices.Clone(w.Attempts), attempt)
+			w.Delivered = delivered
+			w.Remaining = remaining - 1
+			if delivered {
+				w.Remaining = 0
+			}
+			j.Webhook = &w
+		})
+		if delivered {
+			log.WithField("attempts", made).Info("webhook delivered")
+			return
+		}
+		log.WithError(err).WithField("attempt", made).Warn("webhook delivery failed")
+	}
+	log.Error("giving up on webhook delivery")
+}
+
+// postWebhook makes a single delivery attempt. Any 2xx response is a success.
+func postWebhook(callback string, body []byte, signature, id string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+	req.Header.Set("X-Job-ID", id)
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("callback returned %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
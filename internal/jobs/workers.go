@@ -0,0 +1,76 @@
+package jobs
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultWorkers is the worker count used when neither the upload nor the
+	// WORKERS environment variable sets one
+	DefaultWorkers = 4
+	// WorkersAuto picks the worker count from GOMAXPROCS and the upload size
+	WorkersAuto = "auto"
+
+	// autoSequentialBelow is the upload size under which auto mode does not
+	// bother with workers at all
+	autoSequentialBelow = 4 << 20
+	// autoBytesPerWorker is the share of the upload auto mode gives each worker
+	autoBytesPerWorker = 8 << 20
+)
+
+// resolveWorkers picks the processing mode and worker count for an upload of
+// size bytes. The upload's workers option takes precedence over WORKERS and the
+// count never exceeds MAX_WORKERS. Sequential jobs always report one worker.
+func resolveWorkers(option, mode string, size int64) (string, int, error) {
+	setting := option
+	if setting == "" {
+		setting = os.Getenv("WORKERS")
+	}
+
+	workers := DefaultWorkers
+	switch setting = strings.ToLower(strings.TrimSpace(setting)); setting {
+	case "":
+	case WorkersAuto:
+		workers = int((size + autoBytesPerWorker - 1) / autoBytesPerWorker)
+		if procs := runtime.GOMAXPROCS(0); workers > procs {
+			workers = procs
+		}
+		if size < autoSequentialBelow || workers < 2 {
+			return "sequential", 1, nil
+		}
+		if mode == "sequential" {
+			mode = "parallel"
+		}
+	default:
+		n, err := strconv.Atoi(setting)
+		if err != nil || n < 1 {
+			if option == "" {
+				// A bad server setting should not fail every upload
+				break
+			}
+			return "", 0, errors.New("workers must be a positive integer or auto")
+		}
+		workers = n
+	}
+
+	if limit := maxWorkers(); workers > limit {
+		workers = limit
+	}
+	if mode == "sequential" {
+		workers = 1
+	}
+	return mode, workers, nil
+}
+
+// maxWorkers is the server-wide cap from MAX_WORKERS, defaulting to four
+// workers per available CPU
+func maxWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("MAX_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return max(DefaultWorkers, 4*runtime.GOMAXPROCS(0))
+}
@@ -1,32 +1,53 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
-	"mime/multipart"
 	"os"
 	"path/filepath"
 	"time"
 )
 
+// StorageDir holds uploads, outputs and reports. Tests point it elsewhere
+// before any job runs.
+var StorageDir = "storage"
+
 const (
-	StorageDir      = "storage"
-	UploadSuffix    = ".upload"
-	ProcessedSuffix = ".csv"
+	UploadSuffix     = ".upload"
+	ProcessedSuffix  = ".csv"
+	NDJSONSuffix     = ".ndjson"
+	JSONSuffix       = ".json"
+	QuarantineSuffix = ".quarantine.csv"
+	StatsSuffix      = ".stats.json"
+	DomainsSuffix    = ".domains.csv"
+	BatchSuffix      = ".batch.json"
+	// JobLogName is the default job log, kept by CleanupOldFiles
+	JobLogName = "jobs.log"
 )
 
 func EnsureStorage() error {
 	return os.MkdirAll(StorageDir, 0o755)
 }
 
-func SaveUpload(file multipart.File, id string) (string, error) {
+// Upload describes a stored upload
+type Upload struct {
+	Path   string
+	Size   int64
+	SHA256 string // hex-encoded hash of the content
+}
+
+// SaveUpload stores an uploaded file for the job with id, hashing it on the way
+func SaveUpload(file io.Reader, id string) (Upload, error) {
 	path := filepath.Join(StorageDir, id+UploadSuffix)
 	out, err := os.Create(path)
 	if err != nil {
-		return "", err
+		return Upload{}, err
 	}
 	defer out.Close()
-	_, err = io.Copy(out, file)
-	return path, err
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), file)
+	return Upload{Path: path, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, err
 }
 
 // CleanupOldFiles removes files older than the specified duration
@@ -38,7 +59,7 @@ func CleanupOldFiles(maxAge time.Duration) error {
 
 	cutoff := time.Now().Add(-maxAge)
 	for _, file := range files {
-		if file.IsDir() {
+		if file.IsDir() || file.Name() == JobLogName {
 			continue
 		}
 
@@ -59,24 +80,50 @@ func CleanupOldFiles(maxAge time.Duration) error {
 	return nil
 }
 
+// GetJobLogPath returns the default path of the persistent job log
+func GetJobLogPath() string {
+	return filepath.Join(StorageDir, JobLogName)
+}
+
 // GetProcessedFilePath returns the expected path for a processed file
 func GetProcessedFilePath(id string) string {
 	return filepath.Join(StorageDir, id+ProcessedSuffix)
 }
 
-// CleanupJobFiles removes both upload and processed files for a job
-func CleanupJobFiles(id string) error {
-	uploadPath := filepath.Join(StorageDir, id+UploadSuffix)
-	processedPath := filepath.Join(StorageDir, id+ProcessedSuffix)
+// GetOutputFilePath returns the path of a processed file stored with the
+// extension ext
+func GetOutputFilePath(id, ext string) string {
+	return filepath.Join(StorageDir, id+ext)
+}
 
-	var errors []error
+// GetQuarantineFilePath returns the path of the malformed rows file for a job
+func GetQuarantineFilePath(id string) string {
+	return filepath.Join(StorageDir, id+QuarantineSuffix)
+}
 
-	if err := os.Remove(uploadPath); err != nil && !os.IsNotExist(err) {
-		errors = append(errors, err)
-	}
+// GetStatsFilePath returns the path of the statistics report for a job
+func GetStatsFilePath(id string) string {
+	return filepath.Join(StorageDir, id+StatsSuffix)
+}
+
+// GetDomainsReportPath returns the path of the domain aggregation report for a job
+func GetDomainsReportPath(id string) string {
+	return filepath.Join(StorageDir, id+DomainsSuffix)
+}
+
+// GetBatchFilePath returns the path of the record of a batch upload
+func GetBatchFilePath(id string) string {
+	return filepath.Join(StorageDir, id+BatchSuffix)
+}
 
-	if err := os.Remove(processedPath); err != nil && !os.IsNotExist(err) {
-		errors = append(errors, err)
+// CleanupJobFiles removes the upload, processed and report files for a job
+func CleanupJobFiles(id string) error {
+	var errors []error
+
+	for _, suffix := range []string{UploadSuffix, ProcessedSuffix, NDJSONSuffix, JSONSuffix, QuarantineSuffix, StatsSuffix, DomainsSuffix} {
+		if err := os.Remove(filepath.Join(StorageDir, id+suffix)); err != nil && !os.IsNotExist(err) {
+			errors = append(errors, err)
+		}
 	}
 
 	if len(errors) > 0 {
@@ -0,0 +1,88 @@
+package transform
+
+import "fmt"
+
+// DefaultCheckpointInterval is the input consumed between checkpoints when
+// Options.CheckpointInterval is not set
+const DefaultCheckpointInterval = 64 << 20
+
+// Checkpoint marks a point up to which the output of a transform is complete:
+// every row before InputOffset has been flushed to the output, and no row after
+// it
+type Checkpoint struct {
+	// InputOffset is the position in the input just past the last row written
+	InputOffset int64 `json:"input_offset"`
+	// Rows is the number of data rows before InputOffset, as counted by Progress
+	Rows int64 `json:"rows"`
+	// HeaderWidth is the number of header fields, which rows are aligned to
+	HeaderWidth int `json:"header_width"`
+}
+
+// flusher is implemented by RecordWriters that can push buffered records to
+// their output, such as the CSV writer
+type flusher interface {
+	Flush() error
+}
+
+// checkpointer reports Checkpoints to Options.Checkpoint. Offsets and row
+// counts passed to it are relative to where the transform started. All
+// methods accept a nil receiver.
+type checkpointer struct {
+	fn          func(Checkpoint)
+	rw          flusher
+	every       int64
+	base        Checkpoint
+	last        int64
+	headerWidth int
+}
+
+// newCheckpointer returns nil unless checkpoints are wanted and rw can be
+// flushed
+func newCheckpointer(opts *Options, rw RecordWriter) *checkpointer {
+	f, ok := rw.(flusher)
+	if opts.Checkpoint == nil || !ok {
+		return nil
+	}
+	c := &checkpointer{fn: opts.Checkpoint, rw: f, every: opts.CheckpointInterval}
+	if c.every <= 0 {
+		c.every = DefaultCheckpointInterval
+	}
+	if opts.Resume != nil {
+		c.base = *opts.Resume
+		c.headerWidth = opts.Resume.HeaderWidth
+	}
+	return c
+}
+
+// header records the width of the header once it has been written
+func (c *checkpointer) header(width int) {
+	if c != nil {
+		c.headerWidth = width
+	}
+}
+
+// reached records that every row before offset, rows in all, has been written,
+// and checkpoints if enough input has passed since the last checkpoint
+func (c *checkpointer) reached(offset, rows int64) error {
+	if c == nil || offset-c.last < c.every {
+		return nil
+	}
+	if err := c.rw.Flush(); err != nil {
+		return fmt.Errorf("error flushing output: %w", err)
+	}
+	c.last = offset
+	c.fn(Checkpoint{
+		InputOffset: c.base.InputOffset + offset,
+		Rows:        c.base.Rows + rows,
+		HeaderWidth: c.headerWidth,
+	})
+	return nil
+}
+
+// offsetOf returns the input consumed by rr, or -1 if it cannot tell
+func offsetOf(rr RecordReader) int64 {
+	if or, ok := rr.(offsetReader); ok {
+		return or.InputOffset()
+	}
+	return -1
+}
@@ -0,0 +1,329 @@
+package transform
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultChunkSize is the approximate number of input bytes each chunked parse
+// worker takes at a time when Options.ChunkSize is not set
+const DefaultChunkSize = 4 << 20
+
+// chunk is a byte range of the input that starts and ends on record boundaries
+type chunk struct {
+	seq        int
+	start, end int64
+	line       int // line number of the first byte of the range
+	rows       *batch
+	read       int   // records parsed from the range
+	ragged     Stats // padded, truncated and rejected rows in the range
+	err        error
+}
+
+// TransformChunked flags a CSV input by splitting it into byte ranges on record
+// boundaries and parsing the ranges concurrently, which removes the single
+// csv.Reader as the bottleneck for large files. Results are written to rw in
+// input order.
+//
+// Only inputs that can be read at arbitrary offsets qualify, such as stored
+// uploads opened with os.Open. Anything else falls back to streaming through
+// TransformParallelWithOptions, as do lenient transforms, whose recovery from a
+// malformed record depends on everything read before it, and LongRowsReject,
+// whose rejected rows count against the same error budget.
+func TransformChunked(in io.Reader, rw RecordWriter, workerCount int, opts Options) error {
+	return TransformChunkedContext(context.Background(), in, rw, workerCount, opts)
+}
+
+// TransformChunkedContext is TransformChunked that stops with the context's
+// error once ctx is done, after every goroutine it started has exited
+func TransformChunkedContext(ctx context.Context, in io.Reader, rw RecordWriter, workerCount int, opts Options) error {
+	ra, seekable := in.(interface {
+		io.ReaderAt
+		io.Seeker
+	})
+	if !seekable || opts.Lenient || opts.LongRows == LongRowsReject {
+		return TransformParallelContext(ctx, newCSVRecordReader(in), rw, workerCount, opts)
+	}
+	base, err := ra.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return TransformParallelContext(ctx, newCSVRecordReader(in), rw, workerCount, opts)
+	}
+	size, err := ra.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("error sizing input: %w", err)
+	}
+	if _, err := ra.Seek(base, io.SeekStart); err != nil {
+		return fmt.Errorf("error sizing input: %w", err)
+	}
+	return transformRanges(ctx, ra, base, size, rw, workerCount, opts)
+}
+
+func transformRanges(ctx context.Context, in io.ReaderAt, base, size int64, rw RecordWriter, workerCount int, opts Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	stats := newCollector(opts.Stats)
+	progress := newProgressTracker(opts.Progress, opts.Resume)
+	checkpoints := newCheckpointer(&opts, rw)
+
+	// The header is parsed on its own so that the ranges cover data rows only.
+	// A resumed transform starts right at the data.
+	dataStart, firstLine, headerWidth := base, 1, 0
+	if opts.Resume != nil {
+		headerWidth = opts.Resume.HeaderWidth
+	} else {
+		readStart := stats.now()
+		hr := NewCSVReader(io.NewSectionReader(in, base, size-base))
+		rec, err := hr.Read()
+		stats.readDone(readStart)
+		if err == io.EOF {
+			return fmt.Errorf("input appears to be empty or invalid")
+		}
+		if err != nil {
+			return fmt.Errorf("error reading row 1: %w", err)
+		}
+		header := append([]string{}, rec...)
+		headerWidth = len(header)
+		if err := writeHeader(rw, header); err != nil {
+			return fmt.Errorf("error writing header: %w", err)
+		}
+		checkpoints.header(headerWidth)
+		// A quoted header field may span lines, so count them to number the rest
+		dataStart = base + hr.InputOffset()
+		raw := make([]byte, dataStart-base)
+		if _, err := in.ReadAt(raw, base); err != nil {
+			return fmt.Errorf("error reading row 1: %w", err)
+		}
+		firstLine = bytes.Count(raw, []byte{'\n'}) + 1
+	}
+
+	chunkSize := int64(opts.ChunkSize)
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	// Each in-flight chunk holds its parsed rows until they are written
+	inFlight := 2 * workerCount
+	slots := make(chan struct{}, inFlight)
+	ctx, cancel := context.WithCancel(ctx)
+	done := ctx.Done()
+
+	chunkChan := make(chan *chunk, workerCount)
+	// Room for every in-flight chunk plus a split error
+	resChan := make(chan *chunk, inFlight+1)
+	var wg sync.WaitGroup
+
+	// On the way out stop the splitter and workers and wait for them
+	defer func() {
+		cancel()
+		for range resChan {
+		}
+	}()
+
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunkChan {
+				// Chunks still queued after a cancel are passed through unparsed
+				if c.err = ctx.Err(); c.err != nil {
+					resChan <- c
+					continue
+				}
+				c.parse(in, headerWidth, &opts, stats)
+				if c.err == nil {
+					c.rows.flag(&opts, stats)
+				}
+				resChan <- c
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(resChan)
+	}()
+
+	// split the input into ranges
+	go func() {
+		defer close(chunkChan)
+		seq := 0
+		err := splitRecords(in, dataStart, size, chunkSize, firstLine, func(start, end int64, line int) bool {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return false
+			}
+			select {
+			case chunkChan <- &chunk{seq: seq, start: start, end: end, line: line}:
+			case <-done:
+				return false
+			}
+			seq++
+			return true
+		})
+		if err != nil {
+			select {
+			case slots <- struct{}{}:
+				resChan <- &chunk{seq: seq, err: fmt.Errorf("error splitting input: %w", err)}
+			case <-done:
+			}
+		}
+	}()
+
+	// maintain order. In-flight sequence numbers always fall within
+	// [next, next+inFlight), so each has its own slot in the ring. Errors are
+	// reported in order too, as a range split inside a malformed quoted field
+	// may fail to parse after the range that holds the real mistake.
+	pending := make([]*chunk, inFlight)
+	next := 0
+	rowIdx := 1
+	var rows int64
+
+	for {
+		var res *chunk
+		var ok bool
+		select {
+		case res, ok = <-resChan:
+		case <-done:
+			return ctx.Err()
+		}
+		if !ok {
+			break
+		}
+		pending[res.seq%inFlight] = res
+		for pending[next%inFlight] != nil {
+			c := pending[next%inFlight]
+			pending[next%inFlight] = nil
+			if c.err != nil {
+				return c.err
+			}
+
+			stats.rowsRead(c.read)
+			stats.ragged(&c.ragged)
+			err := c.rows.write(rw, &opts, stats, &rowIdx)
+			progress.setBytes(c.end - base)
+			progress.rowsDone(c.read)
+			rows += int64(c.read)
+			if err == nil {
+				err = checkpoints.reached(c.end-base, rows)
+			}
+			putBatch(c.rows)
+			if err != nil {
+				return err
+			}
+			next++
+			<-slots
+		}
+	}
+
+	if err := rw.Close(); err != nil {
+		return fmt.Errorf("error flushing output: %w", err)
+	}
+	stats.finish(0)
+	progress.finish()
+	return nil
+}
+
+// parse reads the records of the chunk's byte range into a batch
+func (c *chunk) parse(in io.ReaderAt, headerWidth int, opts *Options, stats *collector) {
+	// Ragged row counts are kept per chunk and merged in order by the consumer
+	local := *opts
+	local.Stats = nil
+	if opts.Stats != nil {
+		local.Stats = &c.ragged
+	}
+
+	c.rows = getBatch(c.seq)
+	readStart := stats.now()
+	defer stats.readDone(readStart)
+	cr := NewCSVReader(io.NewSectionReader(in, c.start, c.end-c.start))
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// Report the position within the whole input. Records are not
+			// counted across chunks, so the row is numbered by its first line.
+			row := c.line
+			var pe *csv.ParseError
+			if errors.As(err, &pe) {
+				pe.StartLine += c.line - 1
+				pe.Line += c.line - 1
+				row = pe.StartLine
+			}
+			c.err = fmt.Errorf("error reading row %d: %w", row, err)
+			return
+		}
+		c.read++
+		if !isBlankRecord(rec) {
+			var keep bool
+			if rec, keep = local.normalizeWidth(rec, headerWidth); !keep {
+				continue
+			}
+		}
+		c.rows.add(rec)
+	}
+}
+
+// splitRecords cuts [start, end) of in into ranges of roughly chunkSize bytes
+// that end just after a newline outside any quoted field, so every range holds
+// whole records. Quotes inside quoted fields are doubled and so never change
+// whether a position is quoted. emit receives each range and the line it starts
+// on, and stops the split by returning false.
+func splitRecords(in io.ReaderAt, start, end, chunkSize int64, line int, emit func(start, end int64, line int) bool) error {
+	buf := make([]byte, 1<<20)
+	chunkStart := start
+	target := chunkStart + chunkSize
+	lines := 0 // newlines between chunkStart and pos
+	inQuotes := false
+
+	for pos := start; pos < end; {
+		n, err := in.ReadAt(buf[:min(int64(len(buf)), end-pos)], pos)
+		if n == 0 && err != nil {
+			return err
+		}
+		data := buf[:n]
+		for i := 0; i < n; {
+			// Before the target only the quote parity and line count matter
+			if pos+int64(i) < target {
+				j := min(n, int(target-pos))
+				if bytes.Count(data[i:j], []byte{'"'})%2 == 1 {
+					inQuotes = !inQuotes
+				}
+				lines += bytes.Count(data[i:j], []byte{'\n'})
+				i = j
+				continue
+			}
+			b := data[i]
+			i++
+			if b == '"' {
+				inQuotes = !inQuotes
+			} else if b == '\n' {
+				lines++
+				if !inQuotes {
+					if !emit(chunkStart, pos+int64(i), line) {
+						return nil
+					}
+					chunkStart = pos + int64(i)
+					target = chunkStart + chunkSize
+					line += lines
+					lines = 0
+				}
+			}
+		}
+		pos += int64(n)
+	}
+	if chunkStart < end {
+		emit(chunkStart, end, line)
+	}
+	return nil
+}
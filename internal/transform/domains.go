@@ -0,0 +1,126 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultDomainReportCapacity is the number of domains tracked by default
+	DefaultDomainReportCapacity = 5000
+	// domainExamples is the number of example rows kept per domain
+	domainExamples = 3
+)
+
+// DomainReport aggregates rows containing email addresses by domain. Memory is
+// bounded by a top-K sketch: only capacity domains are tracked at once, so for
+// inputs with more domains than that the least frequent are evicted and the
+// counts of those that replace them are upper bounds (see max_overcount).
+type DomainReport struct {
+	sketch *topK[*domainEntry]
+}
+
+type domainEntry struct {
+	addresses *hyperLogLog
+	examples  []string
+}
+
+// NewDomainReport returns a DomainReport tracking at most capacity domains.
+// Non-positive capacities use the default.
+func NewDomainReport(capacity int) *DomainReport {
+	if capacity <= 0 {
+		capacity = DefaultDomainReportCapacity
+	}
+	return &DomainReport{sketch: newTopK[*domainEntry](capacity)}
+}
+
+// add counts rec once for every distinct domain among its addresses
+func (d *DomainReport) add(rec []string, addresses []string) {
+	if d == nil || len(addresses) == 0 {
+		return
+	}
+	var example string
+	seen := make(map[string]bool, len(addresses))
+	for _, addr := range addresses {
+		addr = strings.ToLower(addr)
+		at := strings.LastIndexByte(addr, '@')
+		if at < 0 {
+			continue
+		}
+		domain := addr[at+1:]
+		if seen[domain] {
+			if item, ok := d.sketch.items[domain]; ok {
+				item.value.addresses.add(addr)
+			}
+			continue
+		}
+		seen[domain] = true
+
+		item, fresh := d.sketch.add(domain)
+		if fresh {
+			if item.value == nil {
+				item.value = &domainEntry{addresses: newHyperLogLog(10)}
+			} else {
+				item.value.reset()
+			}
+		}
+		entry := item.value
+		entry.addresses.add(addr)
+		if len(entry.examples) < domainExamples {
+			if example == "" {
+				example = encodeCSVLine(rec)
+			}
+			entry.examples = append(entry.examples, example)
+		}
+	}
+}
+
+func (e *domainEntry) reset() {
+	clear(e.addresses.reg)
+	e.examples = e.examples[:0]
+}
+
+// WriteCSV writes the tracked domains sorted by descending row count
+func (d *DomainReport) WriteCSV(out io.Writer) error {
+	cw := csv.NewWriter(out)
+	header := []string{"domain", "row_count", "distinct_addresses", "max_overcount"}
+	for i := 1; i <= domainExamples; i++ {
+		header = append(header, fmt.Sprintf("example_%d", i))
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, item := range d.sketch.top(-1) {
+		rec := []string{
+			item.key,
+			strconv.FormatInt(item.count, 10),
+			strconv.Itoa(item.value.addresses.count()),
+			strconv.FormatInt(item.err, 10),
+		}
+		for i := 0; i < domainExamples; i++ {
+			example := ""
+			if i < len(item.value.examples) {
+				example = item.value.examples[i]
+			}
+			rec = append(rec, example)
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// encodeCSVLine renders rec as a single CSV line without the trailing newline
+func encodeCSVLine(rec []string) string {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(rec)
+	cw.Flush()
+	return strings.TrimRight(buf.String(), "\n")
+}
@@ -0,0 +1,268 @@
+package transform
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// Format identifies the encoding of an input or output file
+type Format string
+
+const (
+	FormatCSV     Format = "csv"
+	FormatNDJSON  Format = "ndjson"
+	FormatJSON    Format = "json"
+	FormatParquet Format = "parquet"
+)
+
+// HasEmailHeader is the name of the column added by the transforms
+const HasEmailHeader = "hasEmail"
+
+// RecordReader yields one record per call and io.EOF once the input is exhausted.
+// The first record returned is always the header. The returned slice may be
+// reused by the next call, so callers that keep it must copy it.
+type RecordReader interface {
+	Read() ([]string, error)
+}
+
+// RecordWriter receives the header followed by the transformed data records.
+// Close flushes buffered output and writes any trailer; it does not close the
+// underlying io.Writer.
+type RecordWriter interface {
+	Write(record []string) error
+	Close() error
+}
+
+// inputHeaderWriter is implemented by writers that key fields by name. The
+// transforms hand them the input header instead of adding the hasEmail column,
+// so that they can tell an input hasEmail column from the flag.
+type inputHeaderWriter interface {
+	writeInputHeader(header []string) error
+}
+
+// ParseFormat converts a user supplied format name into a Format
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "csv":
+		return FormatCSV, nil
+	case "ndjson", "jsonl", "jsonlines":
+		return FormatNDJSON, nil
+	case "json":
+		return FormatJSON, nil
+	case "parquet":
+		return FormatParquet, nil
+	}
+	return "", fmt.Errorf("unsupported format %q", s)
+}
+
+// FormatFromFilename infers the format from a file extension, defaulting to CSV
+func FormatFromFilename(name string) Format {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON
+	case ".json":
+		return FormatJSON
+	}
+	return FormatCSV
+}
+
+// FormatFromAccept returns the first supported format listed in an Accept header.
+// Wildcards carry no preference and report false.
+func FormatFromAccept(accept string) (Format, bool) {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		for _, f := range []Format{FormatCSV, FormatNDJSON, FormatJSON, FormatParquet} {
+			if mediaType == f.ContentType() {
+				return f, true
+			}
+		}
+		if mediaType == "application/jsonl" || mediaType == "application/jsonlines" {
+			return FormatNDJSON, true
+		}
+	}
+	return "", false
+}
+
+// ContentType returns the MIME type used when serving the format
+func (f Format) ContentType() string {
+	switch f {
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	case FormatJSON:
+		return "application/json"
+	case FormatParquet:
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv"
+}
+
+// Extension returns the file extension conventionally used for the format
+func (f Format) Extension() string {
+	switch f {
+	case FormatNDJSON:
+		return ".ndjson"
+	case FormatJSON:
+		return ".json"
+	case FormatParquet:
+		return ".parquet"
+	}
+	return ".csv"
+}
+
+// IsJSON reports whether the format is NDJSON or a JSON array
+func (f Format) IsJSON() bool {
+	return f == FormatNDJSON || f == FormatJSON
+}
+
+// NewReader returns a RecordReader decoding in according to format. Parquet is
+// an output-only format.
+//
+// JSON input that implements io.Seeker is read twice: once to collect the keys
+// of every object for the header, then for the records. Other JSON input takes
+// its header from the first object, and a later object with a key it lacks is
+// a record error.
+func NewReader(format Format, in io.Reader) (RecordReader, error) {
+	switch format {
+	case FormatCSV, "":
+		return newCSVRecordReader(in), nil
+	case FormatNDJSON:
+		return newJSONReader(in, false), nil
+	case FormatJSON:
+		return newJSONReader(in, true), nil
+	}
+	return nil, fmt.Errorf("unsupported input format %q", format)
+}
+
+// NewWriter returns a RecordWriter encoding to out according to format
+func NewWriter(format Format, out io.Writer) (RecordWriter, error) {
+	switch format {
+	case FormatCSV, "":
+		return NewCSVWriter(out), nil
+	case FormatNDJSON:
+		return newJSONWriter(out, false), nil
+	case FormatJSON:
+		return newJSONWriter(out, true), nil
+	case FormatParquet:
+		return NewParquetWriter(out, DefaultParquetRowGroupSize), nil
+	}
+	return nil, fmt.Errorf("unsupported output format %q", format)
+}
+
+// NewRawReader returns a RecordReader for JSON input whose fields hold the JSON
+// text of each value, empty for a missing key. Transforms reading it need
+// Options.RawJSON, and a writer from NewRawWriter writes the values back with
+// their types.
+func NewRawReader(format Format, in io.Reader) (RecordReader, error) {
+	if !format.IsJSON() {
+		return nil, fmt.Errorf("raw records need JSON input, not %q", format)
+	}
+	r := newJSONReader(in, format == FormatJSON)
+	r.raw = true
+	return r, nil
+}
+
+// NewRawWriter returns a RecordWriter for JSON output that writes each field
+// as the JSON text it holds, and empty fields as null
+func NewRawWriter(format Format, out io.Writer) (RecordWriter, error) {
+	if !format.IsJSON() {
+		return nil, fmt.Errorf("raw records need JSON output, not %q", format)
+	}
+	w := newJSONWriter(out, format == FormatJSON)
+	w.raw = true
+	return w, nil
+}
+
+// NewCSVReader returns a csv.Reader that accepts rows of varying width and
+// reuses its record slice between reads
+func NewCSVReader(in io.Reader) *csv.Reader {
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	return cr
+}
+
+// csvRecordReader reports parse errors as *RecordError carrying the raw text of
+// the offending record. The text of the last record is kept until the next
+// read, for rows rejected after reading.
+type csvRecordReader struct {
+	cr     *csv.Reader
+	tee    *inputTee
+	start  int64
+	offset int64
+}
+
+func newCSVRecordReader(in io.Reader) *csvRecordReader {
+	tee := &inputTee{src: in}
+	return &csvRecordReader{cr: NewCSVReader(tee), tee: tee}
+}
+
+func (r *csvRecordReader) Read() ([]string, error) {
+	r.tee.release(r.offset)
+	rec, err := r.cr.Read()
+	r.start, r.offset = r.offset, r.cr.InputOffset()
+
+	var pe *csv.ParseError
+	if errors.As(err, &pe) {
+		err = &RecordError{Line: pe.StartLine, Raw: r.raw(), Err: err}
+	}
+	return rec, err
+}
+
+// lastRecord returns the line and raw text of the record read last
+func (r *csvRecordReader) lastRecord() (int, string) {
+	line, _ := r.cr.FieldPos(0)
+	return line, r.raw()
+}
+
+func (r *csvRecordReader) raw() string {
+	return strings.TrimRight(string(r.tee.slice(r.start, r.offset)), "\r\n")
+}
+
+type csvWriter struct {
+	cw *csv.Writer
+}
+
+// NewCSVWriter returns a RecordWriter backed by encoding/csv
+func NewCSVWriter(out io.Writer) RecordWriter {
+	return &csvWriter{cw: csv.NewWriter(out)}
+}
+
+func (w *csvWriter) Write(record []string) error {
+	return w.cw.Write(record)
+}
+
+// Flush writes any buffered records to the underlying writer
+func (w *csvWriter) Flush() error {
+	w.cw.Flush()
+	return w.cw.Error()
+}
+
+func (w *csvWriter) Close() error {
+	w.cw.Flush()
+	return w.cw.Error()
+}
+
+// Convert copies every record from rr to rw without transforming it
+func Convert(rr RecordReader, rw RecordWriter) error {
+	for {
+		rec, err := rr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := rw.Write(rec); err != nil {
+			return err
+		}
+	}
+	return rw.Close()
+}
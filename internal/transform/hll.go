@@ -0,0 +1,46 @@
+package transform
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+)
+
+var hllSeed = maphash.MakeSeed()
+
+// hyperLogLog estimates the number of distinct strings added to it using 2^p
+// one-byte registers, so memory stays fixed however many values are seen
+type hyperLogLog struct {
+	p   uint8
+	reg []uint8
+}
+
+func newHyperLogLog(p uint8) *hyperLogLog {
+	return &hyperLogLog{p: p, reg: make([]uint8, 1<<p)}
+}
+
+func (h *hyperLogLog) add(s string) {
+	x := maphash.String(hllSeed, s)
+	idx := x >> (64 - h.p)
+	rho := uint8(bits.LeadingZeros64(x<<h.p|1<<(h.p-1)) + 1)
+	if rho > h.reg[idx] {
+		h.reg[idx] = rho
+	}
+}
+
+func (h *hyperLogLog) count() int {
+	m := float64(len(h.reg))
+	sum, zeros := 0.0, 0
+	for _, r := range h.reg {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Linear counting is far more accurate while many registers are still empty
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
@@ -0,0 +1,346 @@
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// jsonReader decodes a stream of JSON objects (NDJSON) or a single JSON array of
+// objects into records. When the input can seek, the header is every key used
+// by any object, in order of first appearance, and keys an object lacks are
+// empty fields. Otherwise the keys of the first object form the header and a
+// later object with another key is a record error.
+//
+// In raw mode each field holds the compact JSON text of its value instead of
+// a flattened string, so a raw jsonWriter can write it back with its type.
+type jsonReader struct {
+	dec     *json.Decoder
+	src     io.Reader
+	tee     *inputTee
+	array   bool
+	raw     bool
+	header  []string
+	index   map[string]int
+	pending []string
+	done    bool
+	n       int
+}
+
+func newJSONReader(in io.Reader, array bool) *jsonReader {
+	tee := &inputTee{src: in}
+	return &jsonReader{dec: json.NewDecoder(tee), src: in, tee: tee, array: array}
+}
+
+func (r *jsonReader) Read() ([]string, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	if r.header == nil {
+		return r.readHeader()
+	}
+	if r.pending != nil {
+		rec := r.pending
+		r.pending = nil
+		return rec, nil
+	}
+	if !r.dec.More() {
+		return nil, r.finish()
+	}
+
+	start := r.dec.InputOffset()
+	keys, values, err := r.readObject()
+	if err != nil {
+		return nil, err
+	}
+	end := r.dec.InputOffset()
+	defer r.tee.release(end)
+	return r.record(start, end, keys, values)
+}
+
+// record places the values of an object under their header columns
+func (r *jsonReader) record(start, end int64, keys, values []string) ([]string, error) {
+	rec := make([]string, len(r.header))
+	for i, key := range keys {
+		pos, ok := r.index[key]
+		if !ok {
+			return nil, r.recordError(start, end, fmt.Errorf("record %d: unknown field %q", r.n, key))
+		}
+		rec[pos] = values[i]
+	}
+	return rec, nil
+}
+
+func (r *jsonReader) readHeader() ([]string, error) {
+	var union []string
+	if rs, ok := r.src.(io.ReadSeeker); ok {
+		union = scanKeys(rs, r.array)
+	}
+	if r.array {
+		tok, err := r.dec.Token()
+		if err == io.EOF {
+			r.done = true
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := tok.(json.Delim); !ok || d != '[' {
+			return nil, fmt.Errorf("expected JSON array of objects")
+		}
+	}
+	if !r.dec.More() {
+		return nil, r.finish()
+	}
+
+	start := r.dec.InputOffset()
+	keys, values, err := r.readObject()
+	if err != nil {
+		return nil, err
+	}
+	r.header = keys
+	if len(union) > 0 {
+		r.header = union
+	}
+	r.index = make(map[string]int, len(r.header))
+	for i, key := range r.header {
+		r.index[key] = i
+	}
+	if r.pending, err = r.record(start, r.dec.InputOffset(), keys, values); err != nil {
+		return nil, err
+	}
+	return append([]string(nil), r.header...), nil
+}
+
+// scanKeys collects the keys of every object of a seekable input in order of
+// first appearance and rewinds it. It stops at the first decoding error,
+// which the real read then reports.
+func scanKeys(rs io.ReadSeeker, array bool) []string {
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	defer rs.Seek(pos, io.SeekStart)
+
+	dec := json.NewDecoder(rs)
+	if array {
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return nil
+		}
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	for dec.More() {
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+			return keys
+		}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return keys
+			}
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return keys
+			}
+			if key, _ := tok.(string); !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return keys
+		}
+	}
+	return keys
+}
+
+func (r *jsonReader) readObject() ([]string, []string, error) {
+	r.n++
+	tok, err := r.dec.Token()
+	if err != nil {
+		return nil, nil, fmt.Errorf("record %d: %w", r.n, err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return nil, nil, fmt.Errorf("record %d: expected JSON object", r.n)
+	}
+
+	var keys, values []string
+	for r.dec.More() {
+		tok, err := r.dec.Token()
+		if err != nil {
+			return nil, nil, fmt.Errorf("record %d: %w", r.n, err)
+		}
+		key, _ := tok.(string)
+		var raw json.RawMessage
+		if err := r.dec.Decode(&raw); err != nil {
+			return nil, nil, fmt.Errorf("record %d: %w", r.n, err)
+		}
+		keys = append(keys, key)
+		values = append(values, r.value(raw))
+	}
+	if _, err := r.dec.Token(); err != nil {
+		return nil, nil, fmt.Errorf("record %d: %w", r.n, err)
+	}
+	return keys, values, nil
+}
+
+// value turns a decoded value into a field: flattened, or compact JSON text in
+// raw mode
+func (r *jsonReader) value(raw json.RawMessage) string {
+	if !r.raw {
+		return jsonValueString(raw)
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
+
+// recordError wraps err with the raw object text between two input offsets.
+// Only errors raised after an object was fully decoded are recoverable.
+func (r *jsonReader) recordError(start, end int64, err error) error {
+	raw := r.tee.slice(start, end)
+	trimmed := bytes.TrimLeft(raw, ", \t\r\n")
+	line := r.tee.lineAt(start + int64(len(raw)-len(trimmed)))
+	return &RecordError{Line: line, Raw: string(bytes.TrimSpace(trimmed)), Err: err}
+}
+
+// finish consumes the closing bracket of an array input and reports io.EOF
+func (r *jsonReader) finish() error {
+	r.done = true
+	if r.array {
+		if _, err := r.dec.Token(); err != nil {
+			return err
+		}
+	}
+	return io.EOF
+}
+
+// jsonValueString flattens a JSON value into a CSV style field. Strings are
+// unquoted, null becomes empty and anything else keeps its JSON text.
+func jsonValueString(raw json.RawMessage) string {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return s
+		}
+	}
+	if string(raw) == "null" {
+		return ""
+	}
+	return string(raw)
+}
+
+// jsonWriter encodes records as JSON objects keyed by the header, and fields
+// past the header as columnN. The transforms give it the input header, and
+// the final field of each data record is then the hasEmail flag, written as a
+// boolean; when the input already has a hasEmail column the flag replaces its
+// value. A header written as a record is used as it is, for copying output.
+// In raw mode fields are written as the JSON text they hold, and the empty
+// fields of keys an object lacked as null.
+type jsonWriter struct {
+	w      *bufio.Writer
+	array  bool
+	raw    bool
+	header []string
+	flag   int
+	input  bool
+	count  int
+}
+
+func newJSONWriter(out io.Writer, array bool) *jsonWriter {
+	return &jsonWriter{w: bufio.NewWriter(out), array: array, flag: -1}
+}
+
+func (w *jsonWriter) writeInputHeader(header []string) error {
+	w.input = true
+	return w.Write(header)
+}
+
+func (w *jsonWriter) Write(record []string) error {
+	if w.header == nil {
+		w.header = append([]string{}, record...)
+		for i, key := range w.header {
+			if strings.EqualFold(strings.TrimSpace(key), HasEmailHeader) {
+				w.flag = i
+			}
+		}
+		if w.array {
+			_, err := w.w.WriteString("[")
+			return err
+		}
+		return nil
+	}
+
+	// A copied record one field longer than the header ends with the flag too
+	fields, flagged := record, w.input || (w.flag >= 0 && len(record) == len(w.header)+1)
+	if flagged {
+		fields = record[:len(record)-1]
+	}
+
+	var buf bytes.Buffer
+	if w.array && w.count > 0 {
+		buf.WriteByte(',')
+	}
+	buf.WriteByte('{')
+	for i, value := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		switch {
+		case flagged && i == w.flag:
+			w.field(&buf, HasEmailHeader, record[len(record)-1], true)
+		case i < len(w.header):
+			w.field(&buf, w.header[i], value, i == len(record)-1)
+		default:
+			w.field(&buf, fmt.Sprintf("column%d", i+1), value, i == len(record)-1)
+		}
+	}
+	if flagged && (w.flag < 0 || w.flag >= len(fields)) {
+		if len(fields) > 0 {
+			buf.WriteByte(',')
+		}
+		w.field(&buf, HasEmailHeader, record[len(record)-1], true)
+	}
+	buf.WriteByte('}')
+	if !w.array {
+		buf.WriteByte('\n')
+	}
+	w.count++
+	_, err := w.w.Write(buf.Bytes())
+	return err
+}
+
+// field writes a key and its value, the flag as a boolean
+func (w *jsonWriter) field(buf *bytes.Buffer, key, value string, flag bool) {
+	k, _ := json.Marshal(key)
+	buf.Write(k)
+	buf.WriteByte(':')
+	switch {
+	case flag && (value == "true" || value == "false"):
+		buf.WriteString(value)
+	case w.raw && value == "":
+		buf.WriteString("null")
+	case w.raw:
+		buf.WriteString(value)
+	default:
+		v, _ := json.Marshal(value)
+		buf.Write(v)
+	}
+}
+
+func (w *jsonWriter) Close() error {
+	if w.array {
+		if w.header == nil {
+			w.w.WriteString("[")
+		}
+		w.w.WriteString("]\n")
+	}
+	return w.w.Flush()
+}
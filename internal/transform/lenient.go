@@ -0,0 +1,176 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// RecordError reports a malformed record that has been fully consumed from the
+// input, so reading can continue with the next record
+type RecordError struct {
+	Line int
+	Raw  string
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// Quarantine writes malformed records verbatim to a CSV with their line number
+// and the reason they were rejected
+type Quarantine struct {
+	cw    *csv.Writer
+	count int
+}
+
+// NewQuarantine returns a Quarantine writing to out
+func NewQuarantine(out io.Writer) *Quarantine {
+	return &Quarantine{cw: csv.NewWriter(out)}
+}
+
+// Add records a malformed row
+func (q *Quarantine) Add(e *RecordError) error {
+	if q.count == 0 {
+		if err := q.cw.Write([]string{"line", "error", "raw"}); err != nil {
+			return err
+		}
+	}
+	q.count++
+	return q.cw.Write([]string{strconv.Itoa(e.Line), e.Err.Error(), e.Raw})
+}
+
+// Count returns the number of rows quarantined so far
+func (q *Quarantine) Count() int {
+	return q.count
+}
+
+// Close flushes the quarantine file
+func (q *Quarantine) Close() error {
+	q.cw.Flush()
+	return q.cw.Error()
+}
+
+// errorBudget applies the lenient options to read errors and to rows rejected
+// by LongRowsReject
+type errorBudget struct {
+	opts      Options
+	rows      int
+	malformed int
+	rejected  int
+}
+
+// skip reports whether err is a malformed record that lenient mode tolerates.
+// A non-nil error means the transform must stop.
+func (b *errorBudget) skip(err error) (bool, error) {
+	var recErr *RecordError
+	if !b.opts.Lenient || !errors.As(err, &recErr) {
+		return false, nil
+	}
+	if err := b.add(recErr); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reject records a row that was read but dropped by LongRowsReject. A non-nil
+// error means the transform must stop.
+func (b *errorBudget) reject(recErr *RecordError) error {
+	b.rejected++
+	return b.add(recErr)
+}
+
+// add counts a malformed row against the limits and quarantines it
+func (b *errorBudget) add(recErr *RecordError) error {
+	b.malformed++
+	if b.opts.Quarantine != nil {
+		if qerr := b.opts.Quarantine.Add(recErr); qerr != nil {
+			return fmt.Errorf("error writing quarantine row: %w", qerr)
+		}
+	}
+	if b.opts.MaxErrors > 0 && b.malformed > b.opts.MaxErrors {
+		return fmt.Errorf("too many malformed rows: limit of %d exceeded: %w", b.opts.MaxErrors, recErr)
+	}
+	return nil
+}
+
+// records returns the number of records read so far, header included
+func (b *errorBudget) records() int {
+	return b.rows + b.malformed - b.rejected + 1
+}
+
+// finish checks the malformed ratio once every record has been read. Rejected
+// rows were read successfully, so they are already among the rows.
+func (b *errorBudget) finish() error {
+	total := b.rows + b.malformed - b.rejected
+	if b.opts.MaxErrorRatio > 0 && total > 0 {
+		if ratio := float64(b.malformed) / float64(total); ratio > b.opts.MaxErrorRatio {
+			return fmt.Errorf("malformed row ratio %.3f exceeds limit of %.3f", ratio, b.opts.MaxErrorRatio)
+		}
+	}
+	return nil
+}
+
+// inputTee keeps the bytes read from src that have not yet been released, so
+// the raw text of a malformed record can be recovered from its offsets
+type inputTee struct {
+	src   io.Reader
+	buf   []byte
+	base  int64 // input offset of buf[0]
+	start int   // index in buf of the oldest byte still needed
+	lines int   // newlines released before buf[start]
+}
+
+func (t *inputTee) Read(p []byte) (int, error) {
+	n, err := t.src.Read(p)
+	t.buf = append(t.buf, p[:n]...)
+	return n, err
+}
+
+// slice returns the input between two absolute offsets
+func (t *inputTee) slice(from, to int64) []byte {
+	lo, hi := int(from-t.base), int(to-t.base)
+	if lo < t.start {
+		lo = t.start
+	}
+	if hi > len(t.buf) {
+		hi = len(t.buf)
+	}
+	if lo >= hi {
+		return nil
+	}
+	return t.buf[lo:hi]
+}
+
+// lineAt returns the 1-based line number of the given absolute offset
+func (t *inputTee) lineAt(offset int64) int {
+	return t.lines + bytes.Count(t.slice(t.base+int64(t.start), offset), []byte{'\n'}) + 1
+}
+
+// release drops everything before offset
+func (t *inputTee) release(offset int64) {
+	idx := int(offset - t.base)
+	if idx > len(t.buf) {
+		idx = len(t.buf)
+	}
+	if idx <= t.start {
+		return
+	}
+	t.lines += bytes.Count(t.buf[t.start:idx], []byte{'\n'})
+	t.start = idx
+	// Compact once the released prefix dominates the buffer
+	if t.start > 64<<10 && t.start > len(t.buf)/2 {
+		n := copy(t.buf, t.buf[t.start:])
+		t.buf = t.buf[:n]
+		t.base += int64(t.start)
+		t.start = 0
+	}
+}
@@ -0,0 +1,88 @@
+package transform
+
+// Options tunes how the transforms handle problem input. The zero value keeps
+// the strict behaviour where any malformed record fails the transform and rows
+// of any width pass through unchanged.
+type Options struct {
+	// Lenient skips malformed records instead of failing the transform
+	Lenient bool
+	// MaxErrors fails a lenient transform once more records than this are
+	// malformed. Rows dropped by LongRowsReject count as malformed in any
+	// mode. Zero means no limit.
+	MaxErrors int
+	// MaxErrorRatio fails a lenient transform when the share of malformed
+	// records exceeds it. Zero means no limit.
+	MaxErrorRatio float64
+	// Quarantine receives the records skipped in lenient mode and the rows
+	// dropped by LongRowsReject; it may be nil
+	Quarantine *Quarantine
+
+	// PadShortRows extends rows narrower than the header with empty fields
+	PadShortRows bool
+	// LongRows controls rows wider than the header
+	LongRows LongRowPolicy
+
+	// Stats, when set, is filled in with counters describing the run
+	Stats *Stats
+	// Domains, when set, aggregates rows with email addresses by domain
+	Domains *DomainReport
+
+	// Window bounds how many rows the parallel transform holds between reading
+	// and writing. Zero uses DefaultWindow.
+	Window int
+	// BatchSize is the number of rows the parallel transform hands to a worker
+	// at a time. Zero uses DefaultBatchSize; one dispatches rows individually.
+	BatchSize int
+	// ChunkSize is the approximate number of bytes each worker parses at a time
+	// in TransformChunked. Zero uses DefaultChunkSize.
+	ChunkSize int
+	// Progress, when set, is called from the goroutine writing the output as
+	// rows are processed and once more when the transform succeeds
+	Progress func(Progress)
+	// Checkpoint, when set, is called from the goroutine writing the output
+	// each time roughly CheckpointInterval more input bytes have been written,
+	// right after the RecordWriter has been flushed. Only writers with a
+	// Flush method and inputs whose offset is known are checkpointed.
+	Checkpoint func(Checkpoint)
+	// CheckpointInterval is the input consumed between checkpoints. Zero uses
+	// DefaultCheckpointInterval.
+	CheckpointInterval int64
+	// Resume continues a transform from a checkpoint. The input must be
+	// positioned at Resume.InputOffset and the output must hold exactly what
+	// had been written then; the header is neither read nor written again.
+	// Stats and Domains only cover the rows after the checkpoint, and line
+	// numbers in errors count from it.
+	Resume *Checkpoint
+	// RawJSON marks fields holding JSON text, as read by NewRawReader. Email
+	// detection, blank row checks and the domain report see the decoded values
+	// while the records are written unchanged.
+	RawJSON bool
+	// Detector replaces the built-in email detection. It returns whether the
+	// record has an email and, when requested, the addresses it contains.
+	Detector func(rec []string, wantAddresses bool) (bool, []string)
+}
+
+// detect flags rec with the configured detector
+func (o *Options) detect(rec []string) (bool, []string) {
+	if o.Detector != nil {
+		return o.Detector(rec, o.wantAddresses())
+	}
+	return detectEmails(rec, o.wantAddresses())
+}
+
+// text returns the values of rec as detection sees them
+func (o *Options) text(rec []string) []string {
+	if !o.RawJSON {
+		return rec
+	}
+	text := make([]string, len(rec))
+	for i, field := range rec {
+		text[i] = jsonValueString([]byte(field))
+	}
+	return text
+}
+
+// wantAddresses reports whether the matched addresses of each row are needed
+func (o *Options) wantAddresses() bool {
+	return o.Stats != nil || o.Domains != nil
+}
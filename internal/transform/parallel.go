@@ -1,83 +1,232 @@
 package transform
 
 import (
-	"encoding/csv"
+	"context"
 	"fmt"
 	"io"
-	"strings"
+	"strconv"
 	"sync"
 )
 
-type Row struct {
-	Index int
-	Data  []string
+const (
+	// DefaultWindow is the number of rows the parallel transform keeps in flight
+	// when Options.Window is not set
+	DefaultWindow = 8192
+	// DefaultBatchSize is the number of rows handed to a worker at a time when
+	// Options.BatchSize is not set
+	DefaultBatchSize = 256
+)
+
+// batch is a run of consecutive data rows dispatched to a worker together. The
+// fields of every row share one backing slice, each row followed by a spare
+// slot that the worker fills with its flag.
+type batch struct {
+	seq    int
+	fields []string
+	ends   []int // ends[i] is the index in fields just past row i's flag slot
+	meta   []rowMeta
+	err    error
+	read   int   // rows read from the input into the batch, including rejected ones
+	end    int64 // input offset just past the batch, or -1 if unknown
+}
+
+type rowMeta struct {
+	skip      bool
+	hasEmail  bool
+	addresses []string
+}
+
+var batchPool = sync.Pool{New: func() any { return new(batch) }}
+
+func getBatch(seq int) *batch {
+	b := batchPool.Get().(*batch)
+	b.seq = seq
+	return b
+}
+
+func putBatch(b *batch) {
+	clear(b.fields)
+	clear(b.meta)
+	b.fields, b.ends, b.meta, b.err = b.fields[:0], b.ends[:0], b.meta[:0], nil
+	b.read, b.end = 0, 0
+	batchPool.Put(b)
+}
+
+// add copies rec into the batch, since readers may reuse the slice they return
+func (b *batch) add(rec []string) {
+	b.fields = append(b.fields, rec...)
+	b.fields = append(b.fields, "")
+	b.ends = append(b.ends, len(b.fields))
+}
+
+func (b *batch) len() int {
+	return len(b.ends)
+}
+
+// row returns row i including its flag slot
+func (b *batch) row(i int) []string {
+	start := 0
+	if i > 0 {
+		start = b.ends[i-1]
+	}
+	return b.fields[start:b.ends[i]]
 }
-type Result struct {
-	Index int
-	Data  []string
-	Err   error
-	Skip  bool
+
+// flag detects emails in every row of the batch, filling in the flag slots
+func (b *batch) flag(opts *Options, stats *collector) {
+	detectStart := stats.now()
+	for i := 0; i < b.len(); i++ {
+		row := b.row(i)
+		data := opts.text(row[:len(row)-1])
+		// Skip completely empty rows (all fields are empty or whitespace)
+		if isBlankRecord(data) {
+			b.meta = append(b.meta, rowMeta{skip: true})
+			continue
+		}
+		hasEmail, addresses := opts.detect(data)
+		row[len(row)-1] = strconv.FormatBool(hasEmail)
+		b.meta = append(b.meta, rowMeta{hasEmail: hasEmail, addresses: addresses})
+	}
+	stats.detectDone(detectStart)
+}
+
+// write sends the flagged rows of the batch to rw. rowIdx counts the rows
+// written so far, header included, and is advanced past the batch.
+func (b *batch) write(rw RecordWriter, opts *Options, stats *collector, rowIdx *int) error {
+	for i, meta := range b.meta {
+		// Skip empty rows
+		if meta.skip {
+			stats.blankRow()
+			continue
+		}
+		row := b.row(i)
+		writeStart := stats.now()
+		if err := rw.Write(row); err != nil {
+			return fmt.Errorf("error writing data row %d: %w", *rowIdx+1, err)
+		}
+		stats.writeDone(writeStart)
+		stats.rowWritten(meta.hasEmail, meta.addresses)
+		if opts.Domains != nil {
+			opts.Domains.add(opts.text(row[:len(row)-1]), meta.addresses)
+		}
+		*rowIdx++
+	}
+	return nil
 }
 
 func TransformParallel(in io.Reader, out io.Writer, workerCount int) error {
-	cr := csv.NewReader(in)
-	cr.FieldsPerRecord = -1
-	cw := csv.NewWriter(out)
-	defer cw.Flush()
+	return TransformParallelRecords(NewCSVReader(in), NewCSVWriter(out), workerCount)
+}
+
+// TransformParallelRecords flags records from rr using workerCount goroutines and
+// writes them to rw in their original order
+func TransformParallelRecords(rr RecordReader, rw RecordWriter, workerCount int) error {
+	return TransformParallelWithOptions(rr, rw, workerCount, Options{})
+}
+
+// TransformParallelWithOptions is TransformParallelRecords with control over
+// malformed input handling and row width normalization
+func TransformParallelWithOptions(rr RecordReader, rw RecordWriter, workerCount int, opts Options) error {
+	return TransformParallelContext(context.Background(), rr, rw, workerCount, opts)
+}
+
+// TransformParallelContext is TransformParallelWithOptions that stops with the
+// context's error once ctx is done. Every goroutine it starts has exited by the
+// time it returns, so rr and rw are no longer in use; a Read already blocked in
+// rr is waited for.
+func TransformParallelContext(ctx context.Context, rr RecordReader, rw RecordWriter, workerCount int, opts Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	budget := &errorBudget{opts: opts}
+	stats := newCollector(opts.Stats)
+	progress := newProgressTracker(opts.Progress, opts.Resume)
+	checkpoints := newCheckpointer(&opts, rw)
+	if offsetOf(rr) < 0 {
+		checkpoints = nil
+	}
+
+	// The header is handled up front so workers only ever see data rows
+	var header []string
+	if opts.Resume != nil {
+		header = make([]string, opts.Resume.HeaderWidth)
+	}
+	for header == nil {
+		readStart := stats.now()
+		rec, err := rr.Read()
+		stats.readDone(readStart)
+		if err == io.EOF {
+			return fmt.Errorf("input appears to be empty or invalid")
+		}
+		if err != nil {
+			skip, fatal := budget.skip(err)
+			if fatal != nil {
+				return fatal
+			}
+			if skip {
+				continue
+			}
+			return fmt.Errorf("error reading row 1: %w", err)
+		}
+		header = append([]string{}, rec...)
+		if err := writeHeader(rw, header); err != nil {
+			return fmt.Errorf("error writing header: %w", err)
+		}
+		checkpoints.header(len(header))
+	}
+	headerWidth := len(header)
+
+	// Every batch takes a slot from the window before it is filled and gives it
+	// back once written, so the feeder blocks while the oldest batch is still
+	// being worked on and no more than window rows are ever buffered. Batches
+	// shrink when needed so that every worker can hold one.
+	window := opts.Window
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	if window < workerCount {
+		window = workerCount
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if batchSize > window/workerCount {
+		batchSize = window / workerCount
+	}
+	batches := window / batchSize
+
+	slots := make(chan struct{}, batches)
+	ctx, cancel := context.WithCancel(ctx)
+	done := ctx.Done()
 
-	rowChan := make(chan Row, 1000)
-	resChan := make(chan Result, 1000)
+	batchChan := make(chan *batch, workerCount)
+	// Room for every in-flight batch plus a read error, so workers never block
+	resChan := make(chan *batch, batches+1)
 	var wg sync.WaitGroup
-	var headerProcessed bool
-	var headerMutex sync.Mutex
+
+	// On the way out stop the feeder and workers and wait for them. resChan is
+	// only closed once all of them have returned.
+	defer func() {
+		cancel()
+		for range resChan {
+		}
+	}()
 
 	// start workers
 	for i := 0; i < workerCount; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for row := range rowChan {
-				if row.Index == 0 {
-					// Process header row
-					headerMutex.Lock()
-					if !headerProcessed {
-						// Add hasEmail column to header if not already present
-						hasEmailHeader := "hasEmail"
-						headerExists := false
-						for _, field := range row.Data {
-							if strings.TrimSpace(strings.ToLower(field)) == "hasemail" {
-								headerExists = true
-								break
-							}
-						}
-						if !headerExists {
-							row.Data = append(row.Data, hasEmailHeader)
-						}
-						headerProcessed = true
-					}
-					headerMutex.Unlock()
-					resChan <- Result{Index: row.Index, Data: row.Data}
-					continue
-				}
-
-				// Skip completely empty rows (all fields are empty or whitespace)
-				isEmpty := true
-				for _, field := range row.Data {
-					if strings.TrimSpace(field) != "" {
-						isEmpty = false
-						break
-					}
-				}
-				if isEmpty {
-					// Send a special result to indicate this row should be skipped
-					resChan <- Result{Index: row.Index, Data: nil, Skip: true}
-					continue
+			for b := range batchChan {
+				// Batches still queued after a cancel are passed through unflagged
+				if b.err = ctx.Err(); b.err == nil {
+					b.flag(&opts, stats)
 				}
-
-				// Check for email in the row data
-				hasEmail := IsValidEmail(strings.Join(row.Data, " "))
-				row.Data = append(row.Data, fmt.Sprintf("%t", hasEmail))
-				resChan <- Result{Index: row.Index, Data: row.Data}
+				resChan <- b
 			}
 		}()
 	}
@@ -88,58 +237,122 @@ func TransformParallel(in io.Reader, out io.Writer, workerCount int) error {
 		close(resChan)
 	}()
 
-	// feed rows
+	// feed batches
 	go func() {
-		idx := 0
-		for {
-			rec, err := cr.Read()
-			if err == io.EOF {
-				break
+		defer close(batchChan)
+		seq := 0
+		line := 1
+		for eof := false; !eof; seq++ {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
 			}
-			if err != nil {
-				resChan <- Result{Index: idx, Err: fmt.Errorf("error reading CSV row %d: %w", idx+1, err)}
-				break
+			b := getBatch(seq)
+			for b.len() < batchSize {
+				readStart := stats.now()
+				rec, err := rr.Read()
+				stats.readDone(readStart)
+				if err == io.EOF {
+					eof = true
+					break
+				}
+				if err != nil {
+					skip, fatal := budget.skip(err)
+					if skip {
+						continue
+					}
+					if fatal == nil {
+						fatal = fmt.Errorf("error reading row %d: %w", line+1, err)
+					}
+					b.err = fatal
+					resChan <- b
+					return
+				}
+				line++
+				b.read++
+				budget.rows++
+				stats.rowRead()
+				progress.readFrom(rr)
+				// Align ragged rows with the header here, where rows arrive in
+				// order. Rejected rows never make it into a batch.
+				if !isBlankRecord(rec) {
+					var keep bool
+					if rec, keep = opts.normalizeWidth(rec, headerWidth); !keep {
+						if fatal := budget.reject(rejectedRow(rr, rec, line, headerWidth)); fatal != nil {
+							b.err = fatal
+							resChan <- b
+							return
+						}
+						continue
+					}
+				}
+				b.add(rec)
+			}
+			b.end = offsetOf(rr)
+			if b.len() == 0 {
+				putBatch(b)
+				<-slots
+				return
+			}
+			select {
+			case batchChan <- b:
+			case <-done:
+				return
 			}
-			rowChan <- Row{Index: idx, Data: rec}
-			idx++
 		}
-		close(rowChan)
 	}()
 
-	// maintain order
-	pending := make(map[int]Result)
+	// maintain order. In-flight sequence numbers always fall within
+	// [next, next+batches), so each has its own slot in the ring.
+	pending := make([]*batch, batches)
 	next := 0
-	rowsWritten := 0
+	rowIdx := 1
+	var rows int64
 
-	for res := range resChan {
-		if res.Err != nil {
-			return res.Err
+	for {
+		var res *batch
+		var ok bool
+		select {
+		case res, ok = <-resChan:
+		case <-done:
+			return ctx.Err()
 		}
-		pending[res.Index] = res
-		for {
-			if r, ok := pending[next]; ok {
-				// Skip empty rows
-				if r.Skip {
-					delete(pending, next)
-					next++
-					continue
-				}
-				if err := cw.Write(r.Data); err != nil {
-					return fmt.Errorf("error writing data row %d: %w", next+1, err)
-				}
-				rowsWritten++
-				delete(pending, next)
-				next++
-			} else {
-				break
+		if !ok {
+			break
+		}
+		if res.err != nil {
+			return res.err
+		}
+		pending[res.seq%batches] = res
+		for pending[next%batches] != nil {
+			b := pending[next%batches]
+			pending[next%batches] = nil
+
+			err := b.write(rw, &opts, stats, &rowIdx)
+			progress.rowsDone(b.len())
+			rows += int64(b.read)
+			if err == nil {
+				err = checkpoints.reached(b.end, rows)
+			}
+			putBatch(b)
+			if err != nil {
+				return err
 			}
+			next++
+			<-slots
 		}
 	}
 
-	// Ensure we processed at least a header
-	if rowsWritten == 0 {
-		return fmt.Errorf("CSV file appears to be empty or invalid")
+	// The feeder has exited once resChan is closed, so budget is safe to read
+	if err := budget.finish(); err != nil {
+		return err
 	}
 
+	if err := rw.Close(); err != nil {
+		return fmt.Errorf("error flushing output: %w", err)
+	}
+	stats.finish(budget.malformed)
+	progress.finish()
 	return nil
 }
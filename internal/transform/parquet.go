@@ -0,0 +1,140 @@
+package transform
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// DefaultParquetRowGroupSize bounds the rows buffered in memory before a row
+// group is flushed to the output
+const DefaultParquetRowGroupSize = 50000
+
+// parquetWriter encodes records as a Parquet file. Every header column becomes a
+// required string column and the hasEmail flag, taken from the final field
+// of each data record, becomes a boolean column. Only the current row group is
+// held in memory.
+type parquetWriter struct {
+	out          io.Writer
+	rowGroupSize int64
+	pw           *parquet.Writer
+	row          parquet.Row
+}
+
+// NewParquetWriter returns a RecordWriter producing Parquet with at most
+// rowGroupSize rows per row group. Non-positive sizes use the default.
+func NewParquetWriter(out io.Writer, rowGroupSize int) RecordWriter {
+	if rowGroupSize <= 0 {
+		rowGroupSize = DefaultParquetRowGroupSize
+	}
+	return &parquetWriter{out: out, rowGroupSize: int64(rowGroupSize)}
+}
+
+func (w *parquetWriter) Write(record []string) error {
+	if w.pw == nil {
+		return w.writeHeader(record)
+	}
+
+	// Columns follow the header, with the flag last
+	row := w.row
+	last := len(record) - 1
+	flagCol := len(row) - 1
+	for col := range flagCol {
+		value := ""
+		if col < last {
+			value = record[col]
+		}
+		row[col] = parquet.ByteArrayValue([]byte(value)).Level(0, 0, col)
+	}
+	flag := last >= 0 && record[last] == "true"
+	row[flagCol] = parquet.BooleanValue(flag).Level(0, 0, flagCol)
+
+	_, err := w.pw.WriteRows([]parquet.Row{row})
+	return err
+}
+
+// writeHeader builds the schema. The header's final column is the flag when the
+// transform appended it (or the input already ended with it); otherwise a
+// hasEmail column is added.
+func (w *parquetWriter) writeHeader(header []string) error {
+	names := header
+	flagName := HasEmailHeader
+	if n := len(header); n > 0 && strings.EqualFold(strings.TrimSpace(header[n-1]), HasEmailHeader) {
+		names = header[:n-1]
+		flagName = header[n-1]
+	}
+
+	names = uniqueColumnNames(append(append([]string{}, names...), flagName))
+	group := orderedGroup{Group: parquet.Group{}}
+	for i, name := range names {
+		node := parquet.String()
+		if i == len(names)-1 {
+			node = parquet.Leaf(parquet.BooleanType)
+		}
+		group.Group[name] = node
+		group.fields = append(group.fields, orderedField{Node: node, name: name})
+	}
+	schema := parquet.NewSchema("csv_email_flagger", group)
+	w.row = make(parquet.Row, len(names))
+
+	w.pw = parquet.NewWriter(w.out, schema, parquet.MaxRowsPerRowGroup(w.rowGroupSize))
+	return nil
+}
+
+func (w *parquetWriter) Close() error {
+	if w.pw == nil {
+		if err := w.writeHeader(nil); err != nil {
+			return err
+		}
+	}
+	return w.pw.Close()
+}
+
+// orderedGroup is a group node listing its fields in the order they were added.
+// parquet.Group is a map and lists them alphabetically.
+type orderedGroup struct {
+	parquet.Group
+	fields []parquet.Field
+}
+
+func (g orderedGroup) Fields() []parquet.Field { return g.fields }
+
+type orderedField struct {
+	parquet.Node
+	name string
+}
+
+func (f orderedField) Name() string { return f.name }
+
+func (f orderedField) Value(base reflect.Value) reflect.Value {
+	if base.Kind() == reflect.Interface {
+		if base.IsNil() {
+			return reflect.ValueOf(nil)
+		}
+		base = base.Elem()
+	}
+	return base.MapIndex(reflect.ValueOf(f.name))
+}
+
+// uniqueColumnNames replaces blank names and disambiguates duplicates, since
+// Parquet columns are addressed by name
+func uniqueColumnNames(names []string) []string {
+	seen := make(map[string]int, len(names))
+	out := make([]string, len(names))
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			name = fmt.Sprintf("column%d", i+1)
+		}
+		if n := seen[name]; n > 0 {
+			seen[name] = n + 1
+			name = fmt.Sprintf("%s_%d", name, n+1)
+		}
+		seen[name]++
+		out[i] = name
+	}
+	return out
+}
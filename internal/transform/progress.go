@@ -0,0 +1,92 @@
+package transform
+
+import "sync/atomic"
+
+// progressEvery is how many rows pass between progress reports
+const progressEvery = 4096
+
+// Progress describes how far a transform has got through its input
+type Progress struct {
+	// BytesRead is the input consumed so far. It stays zero for readers that
+	// cannot report their offset.
+	BytesRead int64
+	// Rows is the number of data rows that have been through the pipeline,
+	// including blank and rejected rows
+	Rows int64
+	// Done is set on the final report of a successful transform
+	Done bool
+}
+
+// offsetReader is implemented by readers that know how much input they have
+// consumed, such as csv.Reader
+type offsetReader interface {
+	InputOffset() int64
+}
+
+// InputOffset returns the number of input bytes consumed so far
+func (r *csvRecordReader) InputOffset() int64 {
+	return r.offset
+}
+
+// InputOffset returns the number of input bytes consumed so far
+func (r *jsonReader) InputOffset() int64 {
+	return r.dec.InputOffset()
+}
+
+// progressTracker reports Progress to Options.Progress. The byte count is set
+// by whichever goroutine reads the input, rows by the ordered output stage.
+// All methods accept a nil receiver.
+type progressTracker struct {
+	fn    func(Progress)
+	bytes atomic.Int64
+	rows  int64
+	last  int64
+	from  Progress // reached before a resumed transform started
+}
+
+func newProgressTracker(fn func(Progress), resume *Checkpoint) *progressTracker {
+	if fn == nil {
+		return nil
+	}
+	p := &progressTracker{fn: fn}
+	if resume != nil {
+		p.from = Progress{BytesRead: resume.InputOffset, Rows: resume.Rows}
+	}
+	return p
+}
+
+// readFrom records the offset reached by rr, if it reports one
+func (p *progressTracker) readFrom(rr RecordReader) {
+	if p == nil {
+		return
+	}
+	if or, ok := rr.(offsetReader); ok {
+		p.bytes.Store(or.InputOffset())
+	}
+}
+
+// setBytes records the input consumed so far
+func (p *progressTracker) setBytes(n int64) {
+	if p != nil {
+		p.bytes.Store(n)
+	}
+}
+
+// rowsDone counts n rows through the pipeline and reports every progressEvery rows
+func (p *progressTracker) rowsDone(n int) {
+	if p == nil {
+		return
+	}
+	p.rows += int64(n)
+	if p.rows-p.last >= progressEvery {
+		p.last = p.rows
+		p.fn(Progress{BytesRead: p.from.BytesRead + p.bytes.Load(), Rows: p.from.Rows + p.rows})
+	}
+}
+
+// finish sends the final report
+func (p *progressTracker) finish() {
+	if p != nil {
+		p.fn(Progress{BytesRead: p.from.BytesRead + p.bytes.Load(), Rows: p.from.Rows + p.rows, Done: true})
+	}
+}
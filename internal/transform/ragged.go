@@ -0,0 +1,86 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+)
+
+// LongRowPolicy decides what happens to rows wider than the header
+type LongRowPolicy string
+
+const (
+	LongRowsKeep     LongRowPolicy = ""
+	LongRowsTruncate LongRowPolicy = "truncate"
+	LongRowsReject   LongRowPolicy = "reject"
+)
+
+// ParseLongRowPolicy converts a user supplied policy name
+func ParseLongRowPolicy(s string) (LongRowPolicy, error) {
+	switch p := LongRowPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "keep":
+		return LongRowsKeep, nil
+	case LongRowsKeep, LongRowsTruncate, LongRowsReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("unsupported long row policy %q", s)
+}
+
+// normalizeWidth pads or trims rec to the header width according to the options
+// so the hasEmail flag lands in the same column on every row. It reports false
+// when the row must be dropped, which callers pass to the error budget.
+func (o *Options) normalizeWidth(rec []string, width int) ([]string, bool) {
+	switch {
+	case len(rec) < width && o.PadShortRows:
+		for len(rec) < width {
+			rec = append(rec, "")
+		}
+		if o.Stats != nil {
+			o.Stats.PaddedRows++
+		}
+	case len(rec) > width && o.LongRows == LongRowsTruncate:
+		rec = rec[:width]
+		if o.Stats != nil {
+			o.Stats.TruncatedRows++
+		}
+	case len(rec) > width && o.LongRows == LongRowsReject:
+		if o.Stats != nil {
+			o.Stats.RejectedRows++
+		}
+		return rec, false
+	}
+	return rec, true
+}
+
+// recordSource is implemented by readers that can report where the record they
+// returned last came from
+type recordSource interface {
+	lastRecord() (line int, raw string)
+}
+
+// rejectedRow describes a row dropped by LongRowsReject for the error budget.
+// Readers that cannot point at the row report it re-encoded as CSV, at record
+// number n.
+func rejectedRow(rr RecordReader, rec []string, n, width int) *RecordError {
+	err := fmt.Errorf("row has %d fields, more than the %d of the header", len(rec), width)
+	if src, ok := rr.(recordSource); ok {
+		line, raw := src.lastRecord()
+		return &RecordError{Line: line, Raw: raw, Err: err}
+	}
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(rec)
+	cw.Flush()
+	return &RecordError{Line: n, Raw: strings.TrimRight(buf.String(), "\n"), Err: err}
+}
+
+// isBlankRecord reports whether every field is empty or whitespace
+func isBlankRecord(rec []string) bool {
+	for _, field := range rec {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -1,81 +1,147 @@
 package transform
 
 import (
-	"encoding/csv"
+	"context"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 )
 
 var emailRe = EmailRegex()
 
 func TransformSequential(in io.Reader, out io.Writer) error {
-	cr := csv.NewReader(in)
-	cr.FieldsPerRecord = -1
-	cw := csv.NewWriter(out)
-	defer cw.Flush()
+	return TransformSequentialRecords(NewCSVReader(in), NewCSVWriter(out))
+}
+
+// TransformSequentialRecords flags each record from rr and writes it to rw in order
+func TransformSequentialRecords(rr RecordReader, rw RecordWriter) error {
+	return TransformSequentialWithOptions(rr, rw, Options{})
+}
 
+// TransformSequentialWithOptions is TransformSequentialRecords with control over
+// malformed input handling and row width normalization
+func TransformSequentialWithOptions(rr RecordReader, rw RecordWriter, opts Options) error {
+	return TransformSequentialContext(context.Background(), rr, rw, opts)
+}
+
+// TransformSequentialContext is TransformSequentialWithOptions that stops with
+// the context's error once ctx is done. The context is checked between records.
+func TransformSequentialContext(ctx context.Context, rr RecordReader, rw RecordWriter, opts Options) error {
 	rowIdx := 0
 	headerAdded := false
+	headerWidth := 0
+	budget := &errorBudget{opts: opts}
+	stats := newCollector(opts.Stats)
+	progress := newProgressTracker(opts.Progress, opts.Resume)
+	checkpoints := newCheckpointer(&opts, rw)
+	if offsetOf(rr) < 0 {
+		checkpoints = nil
+	}
+	if opts.Resume != nil {
+		headerWidth = opts.Resume.HeaderWidth
+		headerAdded = true
+		rowIdx = 1
+	}
 
 	for {
-		rec, err := cr.Read()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		// Every row read so far has been dealt with
+		if err := checkpoints.reached(offsetOf(rr), int64(budget.rows)); err != nil {
+			return err
+		}
+
+		readStart := stats.now()
+		rec, err := rr.Read()
+		stats.readDone(readStart)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("error reading CSV row %d: %w", rowIdx+1, err)
+			skip, fatal := budget.skip(err)
+			if fatal != nil {
+				return fatal
+			}
+			if skip {
+				continue
+			}
+			return fmt.Errorf("error reading row %d: %w", rowIdx+1, err)
 		}
 
 		// Handle header row
 		if rowIdx == 0 {
-			// Add hasEmail column to header if not already present
-			hasEmailHeader := "hasEmail"
-			headerExists := false
-			for _, field := range rec {
-				if strings.TrimSpace(strings.ToLower(field)) == "hasemail" {
-					headerExists = true
-					break
-				}
-			}
-			if !headerExists {
-				rec = append(rec, hasEmailHeader)
-			}
+			headerWidth = len(rec)
 			headerAdded = true
+			checkpoints.header(headerWidth)
 
-			if err := cw.Write(rec); err != nil {
+			if err := writeHeader(rw, rec); err != nil {
 				return fmt.Errorf("error writing header: %w", err)
 			}
 			rowIdx++
 			continue
 		}
 
+		budget.rows++
+		stats.rowRead()
+		progress.readFrom(rr)
+		progress.rowsDone(1)
+
 		// Skip completely empty rows (all fields are empty or whitespace)
 		isEmpty := true
-		for _, field := range rec {
+		for _, field := range opts.text(rec) {
 			if strings.TrimSpace(field) != "" {
 				isEmpty = false
 				break
 			}
 		}
 		if isEmpty {
+			stats.blankRow()
+			continue
+		}
+
+		// Align ragged rows with the header
+		rec, keep := opts.normalizeWidth(rec, headerWidth)
+		if !keep {
+			if err := budget.reject(rejectedRow(rr, rec, budget.records(), headerWidth)); err != nil {
+				return err
+			}
 			continue
 		}
 
 		// Check for email in the row data
-		hasEmail := IsValidEmail(strings.Join(rec, " "))
-		rec = append(rec, fmt.Sprintf("%t", hasEmail))
+		detectStart := stats.now()
+		hasEmail, addresses := opts.detect(opts.text(rec))
+		stats.detectDone(detectStart)
+		rec = append(rec, strconv.FormatBool(hasEmail))
 
-		if err := cw.Write(rec); err != nil {
+		writeStart := stats.now()
+		if err := rw.Write(rec); err != nil {
 			return fmt.Errorf("error writing data row %d: %w", rowIdx+1, err)
 		}
+		stats.writeDone(writeStart)
+		stats.rowWritten(hasEmail, addresses)
+		if opts.Domains != nil {
+			opts.Domains.add(opts.text(rec[:len(rec)-1]), addresses)
+		}
 		rowIdx++
 	}
 
 	// Ensure we processed at least a header
 	if !headerAdded {
-		return fmt.Errorf("CSV file appears to be empty or invalid")
+		return fmt.Errorf("input appears to be empty or invalid")
+	}
+	if err := budget.finish(); err != nil {
+		return err
 	}
 
+	if err := rw.Close(); err != nil {
+		return fmt.Errorf("error flushing output: %w", err)
+	}
+	stats.finish(budget.malformed)
+	progress.finish()
 	return nil
 }
@@ -0,0 +1,172 @@
+package transform
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// topDomainsReported is how many domains Stats.TopDomains lists
+	topDomainsReported = 10
+	// topDomainsTracked bounds the domains held by the top-K sketch
+	topDomainsTracked = 1000
+)
+
+// Stats counts what a transform did to its input
+type Stats struct {
+	RowsRead          int           `json:"rows_read"`
+	RowsWritten       int           `json:"rows_written"`
+	BlankRowsSkipped  int           `json:"blank_rows_skipped"`
+	RowsWithEmail     int           `json:"rows_with_email"`
+	DistinctAddresses int           `json:"distinct_addresses"` // estimated
+	TopDomains        []DomainCount `json:"top_domains"`
+	MalformedRows     int           `json:"malformed_rows"`
+
+	PaddedRows    int `json:"padded_rows"`
+	TruncatedRows int `json:"truncated_rows"`
+	RejectedRows  int `json:"rejected_rows"`
+
+	Timings Timings `json:"timings"`
+}
+
+// DomainCount is the number of email addresses seen for a domain
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Count  int64  `json:"count"`
+}
+
+// Timings records the time spent in each phase of a transform. In parallel
+// mode Detect is summed across workers and can exceed Total, as can Read when
+// chunked parsing reads byte ranges concurrently.
+type Timings struct {
+	Read   Duration `json:"read"`
+	Detect Duration `json:"detect"`
+	Write  Duration `json:"write"`
+	Total  Duration `json:"total"`
+}
+
+// Duration is a time.Duration that marshals to JSON as a string such as "1.5s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + time.Duration(d).String() + `"`), nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	parsed, err := time.ParseDuration(strings.Trim(string(b), `"`))
+	*d = Duration(parsed)
+	return err
+}
+
+// collector gathers Stats while a transform runs. Counters owned by the reader
+// (ragged rows) and by the ordered output stage are only touched by one
+// goroutine each; read and detection time may be shared by workers and are
+// kept atomically.
+type collector struct {
+	s         *Stats
+	start     time.Time
+	read      atomic.Int64
+	detect    atomic.Int64
+	addresses *hyperLogLog
+	domains   *topK[struct{}]
+}
+
+// newCollector returns nil when no stats were requested; all methods accept a
+// nil receiver
+func newCollector(s *Stats) *collector {
+	if s == nil {
+		return nil
+	}
+	return &collector{
+		s:         s,
+		start:     time.Now(),
+		addresses: newHyperLogLog(14),
+		domains:   newTopK[struct{}](topDomainsTracked),
+	}
+}
+
+// now returns the current time when stats are being collected
+func (c *collector) now() time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (c *collector) readDone(since time.Time) {
+	if c != nil {
+		c.read.Add(int64(time.Since(since)))
+	}
+}
+
+func (c *collector) detectDone(since time.Time) {
+	if c != nil {
+		c.detect.Add(int64(time.Since(since)))
+	}
+}
+
+func (c *collector) writeDone(since time.Time) {
+	if c != nil {
+		c.s.Timings.Write += Duration(time.Since(since))
+	}
+}
+
+func (c *collector) rowRead() {
+	c.rowsRead(1)
+}
+
+func (c *collector) rowsRead(n int) {
+	if c != nil {
+		c.s.RowsRead += n
+	}
+}
+
+func (c *collector) blankRow() {
+	if c != nil {
+		c.s.BlankRowsSkipped++
+	}
+}
+
+// ragged adds the padded, truncated and rejected row counts of r
+func (c *collector) ragged(r *Stats) {
+	if c != nil {
+		c.s.PaddedRows += r.PaddedRows
+		c.s.TruncatedRows += r.TruncatedRows
+		c.s.RejectedRows += r.RejectedRows
+	}
+}
+
+// rowWritten records an output row and the addresses detected in it
+func (c *collector) rowWritten(hasEmail bool, addresses []string) {
+	if c == nil {
+		return
+	}
+	c.s.RowsWritten++
+	if hasEmail {
+		c.s.RowsWithEmail++
+	}
+	for _, addr := range addresses {
+		addr = strings.ToLower(addr)
+		c.addresses.add(addr)
+		if at := strings.LastIndexByte(addr, '@'); at >= 0 {
+			c.domains.add(addr[at+1:])
+		}
+	}
+}
+
+// finish fills in the derived fields once the transform has completed
+func (c *collector) finish(malformed int) {
+	if c == nil {
+		return
+	}
+	c.s.MalformedRows = malformed
+	c.s.DistinctAddresses = c.addresses.count()
+	c.s.TopDomains = c.s.TopDomains[:0]
+	for _, item := range c.domains.top(topDomainsReported) {
+		c.s.TopDomains = append(c.s.TopDomains, DomainCount{Domain: item.key, Count: item.count})
+	}
+	c.s.Timings.Read = Duration(c.read.Load())
+	c.s.Timings.Detect = Duration(c.detect.Load())
+	c.s.Timings.Total = Duration(time.Since(c.start))
+}
@@ -0,0 +1,97 @@
+package transform
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// topK tracks the most frequent keys with the Space-Saving algorithm. At most
+// capacity keys are held; when a new key arrives at capacity it replaces the
+// least frequent one and inherits its count as an overestimate. Each entry
+// carries a value of type V for callers that aggregate more than a count.
+type topK[V any] struct {
+	capacity int
+	items    map[string]*topKItem[V]
+	heap     topKHeap[V]
+}
+
+type topKItem[V any] struct {
+	key   string
+	count int64
+	err   int64 // upper bound on how much count overestimates the true value
+	value V
+	index int
+}
+
+func newTopK[V any](capacity int) *topK[V] {
+	return &topK[V]{capacity: capacity, items: make(map[string]*topKItem[V], capacity)}
+}
+
+// add counts one occurrence of key and returns its entry. fresh is true when the
+// entry is new to key, either newly created or taken over from an evicted key,
+// and its value must be reinitialised.
+func (t *topK[V]) add(key string) (item *topKItem[V], fresh bool) {
+	if item, ok := t.items[key]; ok {
+		item.count++
+		heap.Fix(&t.heap, item.index)
+		return item, false
+	}
+	if len(t.heap) < t.capacity {
+		item = &topKItem[V]{key: key, count: 1}
+		heap.Push(&t.heap, item)
+		t.items[key] = item
+		return item, true
+	}
+
+	item = t.heap[0]
+	delete(t.items, item.key)
+	item.key = key
+	item.err = item.count
+	item.count++
+	t.items[key] = item
+	heap.Fix(&t.heap, 0)
+	return item, true
+}
+
+// top returns up to n entries ordered by their guaranteed count (count - err),
+// then count, then key. A negative n returns every entry.
+func (t *topK[V]) top(n int) []*topKItem[V] {
+	items := make([]*topKItem[V], len(t.heap))
+	copy(items, t.heap)
+	sort.Slice(items, func(i, j int) bool {
+		gi, gj := items[i].count-items[i].err, items[j].count-items[j].err
+		if gi != gj {
+			return gi > gj
+		}
+		if items[i].count != items[j].count {
+			return items[i].count > items[j].count
+		}
+		return items[i].key < items[j].key
+	})
+	if n >= 0 && len(items) > n {
+		items = items[:n]
+	}
+	return items
+}
+
+// topKHeap is a min-heap on count so the eviction candidate is at the root
+type topKHeap[V any] []*topKItem[V]
+
+func (h topKHeap[V]) Len() int           { return len(h) }
+func (h topKHeap[V]) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap[V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *topKHeap[V]) Push(x any) {
+	item := x.(*topKItem[V])
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *topKHeap[V]) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
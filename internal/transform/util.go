@@ -27,3 +27,45 @@ func IsValidEmail(email string) bool {
 
 	return true
 }
+
+// detectEmails reports whether rec contains a valid email address and, when
+// wantAddresses is set, returns the addresses it contains. Rows without an '@'
+// cannot match and skip the regex entirely.
+func detectEmails(rec []string, wantAddresses bool) (bool, []string) {
+	hasAt := false
+	for _, field := range rec {
+		if strings.IndexByte(field, '@') >= 0 {
+			hasAt = true
+			break
+		}
+	}
+	if !hasAt {
+		return false, nil
+	}
+
+	line := strings.Join(rec, " ")
+	hasEmail := IsValidEmail(line)
+	if !hasEmail || !wantAddresses {
+		return hasEmail, nil
+	}
+	return true, emailRe.FindAllString(line, -1)
+}
+
+// writeHeader writes the output header for the input header to rw
+func writeHeader(rw RecordWriter, header []string) error {
+	if hw, ok := rw.(inputHeaderWriter); ok {
+		return hw.writeInputHeader(header)
+	}
+	return rw.Write(headerWithFlag(header))
+}
+
+// headerWithFlag appends the hasEmail column to a header unless a column of that
+// name (in any case) is already present
+func headerWithFlag(header []string) []string {
+	for _, field := range header {
+		if strings.TrimSpace(strings.ToLower(field)) == "hasemail" {
+			return header
+		}
+	}
+	return append(header, HasEmailHeader)
+}
@@ -1,21 +1,33 @@
 package functional
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
 	"csv-email-flagger/internal/api"
+	"csv-email-flagger/internal/jobs"
 	"csv-email-flagger/internal/storage"
+	"csv-email-flagger/internal/transform"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 func newTestServer() *httptest.Server {
@@ -252,3 +264,1632 @@ func TestHealth(t *testing.T) {
 		t.Fatalf("health check returned %d", res.StatusCode)
 	}
 }
+
+func uploadJob(t *testing.T, ts *httptest.Server, filename, content string, fields map[string]string) string {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	io.Copy(part, strings.NewReader(content))
+	writer.Close()
+
+	res, err := http.Post(ts.URL+"/api/upload", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("upload returned %d", res.StatusCode)
+	}
+	var response map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	id, ok := response["id"].(string)
+	if !ok {
+		t.Fatal("no job ID in response")
+	}
+	return id
+}
+
+func waitForStatus(t *testing.T, ts *httptest.Server, id string, want string) map[string]interface{} {
+	t.Helper()
+	var status map[string]interface{}
+	for i := 0; i < 100; i++ {
+		res, err := http.Get(ts.URL + "/api/status/" + id)
+		if err != nil {
+			t.Fatalf("status check failed: %v", err)
+		}
+		status = nil
+		json.NewDecoder(res.Body).Decode(&status)
+		res.Body.Close()
+		if status["status"] == want {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not reach %s, last status %v", id, want, status)
+	return nil
+}
+
+func TestDownload_FormatNegotiation(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	ndjson := `{"name":"Alice","email":"alice@example.com"}
+{"name":"Bob","email":"not-an-email"}
+`
+	id := uploadJob(t, ts, "people.ndjson", ndjson, map[string]string{"output_format": "ndjson"})
+	waitForStatus(t, ts, id, "DONE")
+
+	res, err := http.Get(ts.URL + "/api/download/" + id)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	got, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected ndjson content type, got %q", ct)
+	}
+	expected := `{"name":"Alice","email":"alice@example.com","hasEmail":true}
+{"name":"Bob","email":"not-an-email","hasEmail":false}
+`
+	if string(got) != expected {
+		t.Errorf("unexpected output\nGot:\n%s\nWant:\n%s", got, expected)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/download/"+id, nil)
+	req.Header.Set("Accept", "text/csv")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	got, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(got) != "name,email,hasEmail\nAlice,alice@example.com,true\nBob,not-an-email,false\n" {
+		t.Errorf("unexpected CSV output: %s", got)
+	}
+}
+
+func TestDownload_JSONKeepsValueTypes(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	ndjson := `{"name":"Alice","age":30,"active":true,"contact":{"email":"alice@example.com"}}
+{"name":"Bob","age":null,"tags":["a"]}
+`
+	id := uploadJob(t, ts, "people.ndjson", ndjson, map[string]string{"output_format": "json"})
+	waitForStatus(t, ts, id, "DONE")
+
+	cases := map[string]string{
+		"": `[{"name":"Alice","age":30,"active":true,"contact":{"email":"alice@example.com"},"tags":null,"hasEmail":true},{"name":"Bob","age":null,"active":null,"contact":null,"tags":["a"],"hasEmail":false}]
+`,
+		"application/x-ndjson": `{"name":"Alice","age":30,"active":true,"contact":{"email":"alice@example.com"},"tags":null,"hasEmail":true}
+{"name":"Bob","age":null,"active":null,"contact":null,"tags":["a"],"hasEmail":false}
+`,
+		"text/csv": `name,age,active,contact,tags,hasEmail
+Alice,30,true,"{""email"":""alice@example.com""}",,true
+Bob,,,,"[""a""]",false
+`,
+	}
+	for accept, expected := range cases {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/download/"+id, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("download failed: %v", err)
+		}
+		got, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(got) != expected {
+			t.Errorf("Accept %q: unexpected output\nGot:\n%s\nWant:\n%s", accept, got, expected)
+		}
+	}
+}
+
+func TestUpload_InvalidFormat(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("output_format", "xml")
+	part, _ := writer.CreateFormFile("file", "test.csv")
+	io.Copy(part, strings.NewReader("name,email\n"))
+	writer.Close()
+
+	res, err := http.Post(ts.URL+"/api/upload", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("expected 400 for unsupported format, got %d", res.StatusCode)
+	}
+}
+
+func TestDownload_Parquet(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	id := uploadJob(t, ts, "test.csv", "name,email\nAlice,alice@example.com\n", map[string]string{
+		"output_format":  "parquet",
+		"row_group_size": "1000",
+	})
+	waitForStatus(t, ts, id, "DONE")
+
+	res, err := http.Get(ts.URL + "/api/download/" + id)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	got, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/vnd.apache.parquet" {
+		t.Errorf("expected parquet content type, got %q", ct)
+	}
+	if !bytes.HasPrefix(got, []byte("PAR1")) || !bytes.HasSuffix(got, []byte("PAR1")) {
+		t.Errorf("download is not a parquet file")
+	}
+}
+
+func TestUpload_LenientQuarantine(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	csvContent := "name,email\nAlice,alice@example.com\nBob,bob\"@example.com\n"
+	id := uploadJob(t, ts, "test.csv", csvContent, map[string]string{"lenient": "true"})
+	status := waitForStatus(t, ts, id, "DONE_WITH_ERRORS")
+	if status["malformed_rows"] != float64(1) {
+		t.Errorf("expected 1 malformed row, got %v", status["malformed_rows"])
+	}
+
+	res, err := http.Get(ts.URL + "/api/download/" + id + "/quarantine")
+	if err != nil {
+		t.Fatalf("quarantine download failed: %v", err)
+	}
+	got, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || !strings.Contains(string(got), `3,`) {
+		t.Errorf("unexpected quarantine response %d:\n%s", res.StatusCode, got)
+	}
+
+	res, err = http.Get(ts.URL + "/api/download/" + id)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected processed output to be downloadable, got %d", res.StatusCode)
+	}
+}
+
+func TestUpload_RejectedLongRowsQuarantined(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	csvContent := "name,email\nAlice,alice@example.com\nBob,bob@example.com,extra\n"
+	id := uploadJob(t, ts, "test.csv", csvContent, map[string]string{"long_rows": "reject", "mode": "chunked"})
+	status := waitForStatus(t, ts, id, "DONE_WITH_ERRORS")
+	if status["malformed_rows"] != float64(1) {
+		t.Errorf("expected 1 malformed row, got %v", status["malformed_rows"])
+	}
+
+	res, err := http.Get(ts.URL + "/api/download/" + id + "/quarantine")
+	if err != nil {
+		t.Fatalf("quarantine download failed: %v", err)
+	}
+	got, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	expected := "line,error,raw\n3,\"row has 3 fields, more than the 2 of the header\",\"Bob,bob@example.com,extra\"\n"
+	if res.StatusCode != 200 || string(got) != expected {
+		t.Errorf("unexpected quarantine response %d:\n%s", res.StatusCode, got)
+	}
+
+	id = uploadJob(t, ts, "test.csv", csvContent, map[string]string{"long_rows": "reject", "max_error_ratio": "0.4"})
+	waitForStatus(t, ts, id, "FAILED")
+}
+
+func TestStatsReport(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	csvContent := "name,email\nAlice,alice@example.com\nBob,not-an-email\n"
+	id := uploadJob(t, ts, "test.csv", csvContent, nil)
+	status := waitForStatus(t, ts, id, "DONE")
+	stats, ok := status["stats"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected stats in status response, got %v", status)
+	}
+	if stats["rows_written"] != float64(2) || stats["rows_with_email"] != float64(1) {
+		t.Errorf("unexpected stats %v", stats)
+	}
+
+	res, err := http.Get(ts.URL + "/api/jobs/" + id + "/reports/stats")
+	if err != nil {
+		t.Fatalf("report download failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("report returned %d", res.StatusCode)
+	}
+	var report struct {
+		JobID string                 `json:"job_id"`
+		Stats map[string]interface{} `json:"stats"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+	if report.JobID != id || report.Stats["distinct_addresses"] != float64(1) {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestDomainsReport(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	csvContent := "name,email\nAlice,alice@example.com\nBob,bob@example.com\nCarol,carol@test.org\n"
+	id := uploadJob(t, ts, "test.csv", csvContent, map[string]string{"domain_report": "true"})
+	waitForStatus(t, ts, id, "DONE")
+
+	res, err := http.Get(ts.URL + "/api/jobs/" + id + "/reports/domains")
+	if err != nil {
+		t.Fatalf("report download failed: %v", err)
+	}
+	got, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("report returned %d", res.StatusCode)
+	}
+	lines := strings.Split(strings.TrimSpace(string(got)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "example.com,2,2,0,") {
+		t.Errorf("unexpected domains report:\n%s", got)
+	}
+
+	// Jobs uploaded without domain_report have no report
+	id = uploadJob(t, ts, "test.csv", csvContent, nil)
+	waitForStatus(t, ts, id, "DONE")
+	res, err = http.Get(ts.URL + "/api/jobs/" + id + "/reports/domains")
+	if err != nil {
+		t.Fatalf("report download failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 without domain_report, got %d", res.StatusCode)
+	}
+}
+
+func TestUpload_Workers(t *testing.T) {
+	_ = storage.EnsureStorage()
+	t.Setenv("PROCESS_MODE", "parallel")
+	t.Setenv("MAX_WORKERS", "3")
+	ts := newTestServer()
+	defer ts.Close()
+
+	csvContent := "name,email\nAlice,alice@example.com\n"
+	id := uploadJob(t, ts, "test.csv", csvContent, map[string]string{"workers": "2"})
+	status := waitForStatus(t, ts, id, "DONE")
+	if status["mode"] != "parallel" || status["workers"] != float64(2) {
+		t.Errorf("expected parallel with 2 workers, got mode %v workers %v", status["mode"], status["workers"])
+	}
+
+	// The server cap wins over the upload
+	id = uploadJob(t, ts, "test.csv", csvContent, map[string]string{"workers": "16"})
+	status = waitForStatus(t, ts, id, "DONE")
+	if status["workers"] != float64(3) {
+		t.Errorf("expected workers capped at 3, got %v", status["workers"])
+	}
+
+	// Small files run sequentially in auto mode
+	t.Setenv("WORKERS", "auto")
+	id = uploadJob(t, ts, "test.csv", csvContent, nil)
+	status = waitForStatus(t, ts, id, "DONE")
+	if status["mode"] != "sequential" || status["workers"] != float64(1) {
+		t.Errorf("expected auto to pick sequential, got mode %v workers %v", status["mode"], status["workers"])
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("workers", "many")
+	part, _ := writer.CreateFormFile("file", "test.csv")
+	io.Copy(part, strings.NewReader(csvContent))
+	writer.Close()
+	res, err := http.Post(ts.URL+"/api/upload", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("expected 400 for invalid workers, got %d", res.StatusCode)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	// Large enough to still be processing when the cancel arrives
+	content := "name,email\n" + strings.Repeat("Alice,alice@example.com\n", 800000)
+	id := uploadJob(t, ts, "big.csv", content, nil)
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/jobs/"+id, nil)
+	req.Header.Set("X-User", "tester")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("cancel failed: %v", err)
+	}
+	var job map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&job)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("cancel returned %d", res.StatusCode)
+	}
+	if job["status"] != "CANCELLED" || job["cancelled_by"] != "tester" || job["cancelled_at"] == nil {
+		t.Errorf("unexpected cancelled job: %v", job)
+	}
+
+	// The job stays cancelled and its files are removed
+	status := waitForStatus(t, ts, id, "CANCELLED")
+	if status["cancelled_by"] != "tester" {
+		t.Errorf("status does not report the canceller: %v", status)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, uploadErr := os.Stat(filepath.Join(storage.StorageDir, id+storage.UploadSuffix))
+		_, outputErr := os.Stat(storage.GetProcessedFilePath(id))
+		if os.IsNotExist(uploadErr) && os.IsNotExist(outputErr) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled job files were not cleaned up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res, err = http.Get(ts.URL + "/api/download/" + id)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("expected 410 downloading a cancelled job, got %d", res.StatusCode)
+	}
+
+	// Finished jobs cannot be cancelled
+	id = uploadJob(t, ts, "test.csv", "name,email\nAlice,alice@example.com\n", nil)
+	waitForStatus(t, ts, id, "DONE")
+	res, err = http.Post(ts.URL+"/api/jobs/"+id+"/cancel", "", nil)
+	if err != nil {
+		t.Fatalf("cancel failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409 cancelling a finished job, got %d", res.StatusCode)
+	}
+}
+
+func TestStatus_Progress(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	csvContent := "name,email\nAlice,alice@example.com\nBob,bob\n"
+	id := uploadJob(t, ts, "test.csv", csvContent, nil)
+	status := waitForStatus(t, ts, id, "DONE")
+
+	progress, ok := status["progress"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("status has no progress: %v", status)
+	}
+	if progress["percent"] != float64(100) || progress["rows_processed"] != float64(2) ||
+		progress["total_bytes"] != float64(len(csvContent)) || progress["eta_seconds"] != float64(0) {
+		t.Errorf("unexpected progress for a finished job: %v", progress)
+	}
+}
+
+// readEvents collects the Server-Sent Events of a stream until it closes
+func readEvents(t *testing.T, url string) []map[string]interface{} {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("events request failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected events response %d %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			var event map[string]interface{}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatalf("bad event data %q: %v", data, err)
+			}
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestJobEvents(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	content := "name,email\n" + strings.Repeat("Alice,alice@example.com\n", 50000)
+	id := uploadJob(t, ts, "big.csv", content, nil)
+
+	done := make(chan []map[string]interface{})
+	go func() { done <- readEvents(t, ts.URL+"/api/jobs/"+id+"/events") }()
+	var events []map[string]interface{}
+	select {
+	case events = <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("event stream did not close after the job finished")
+	}
+
+	if len(events) == 0 {
+		t.Fatal("no events received")
+	}
+	last := events[len(events)-1]
+	if last["type"] != "status" || last["status"] != "DONE" || last["job_id"] != id {
+		t.Errorf("expected the stream to end with DONE, got %v", last)
+	}
+
+	// A finished job yields its final state and closes immediately
+	events = readEvents(t, ts.URL+"/api/jobs/"+id+"/events")
+	if len(events) != 1 || events[0]["status"] != "DONE" {
+		t.Errorf("unexpected events for a finished job: %v", events)
+	}
+}
+
+func TestMonitorWebSocket(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws"
+
+	// Jobs outlive the test server, so use a tag no earlier run has seen
+	tag := fmt.Sprintf("nightly-%d", time.Now().UnixNano())
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?tag="+tag, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	csvContent := "name,email\nAlice,alice@example.com\n"
+	tagged := map[string]bool{
+		uploadJob(t, ts, "a.csv", csvContent, map[string]string{"tags": tag + ",eu"}): true,
+		uploadJob(t, ts, "b.csv", csvContent, map[string]string{"tags": tag}): true,
+	}
+	untagged := uploadJob(t, ts, "c.csv", csvContent, nil)
+
+	var first jobs.Event
+	finished := map[string]bool{}
+	for len(finished) < len(tagged) {
+		var msg jobs.MonitorMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if msg.Event == nil {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+		e := *msg.Event
+		if e.JobID == untagged || !tagged[e.JobID] {
+			t.Fatalf("received event for an unwatched job: %+v", e)
+		}
+		if first.Seq == 0 && msg.Type == "event" {
+			first = e
+		}
+		if e.Status == jobs.StatusDone {
+			finished[e.JobID] = true
+		}
+	}
+
+	// Unknown requests are rejected without closing the connection
+	conn.WriteJSON(jobs.MonitorRequest{Type: "bogus"})
+	var msg jobs.MonitorMessage
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "error" {
+		t.Errorf("expected an error message, got %+v (%v)", msg, err)
+	}
+
+	// A reconnecting client resumes after the last event it saw
+	resumed, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?job_id=%s&last_seq=%d", wsURL, first.JobID, first.Seq), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer resumed.Close()
+	resumed.SetReadDeadline(time.Now().Add(10 * time.Second))
+	lastSeq := first.Seq
+	for {
+		var msg jobs.MonitorMessage
+		if err := resumed.ReadJSON(&msg); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if msg.Type != "event" || msg.Event.JobID != first.JobID {
+			t.Fatalf("unexpected replayed message %+v", msg)
+		}
+		if msg.Event.Seq <= lastSeq {
+			t.Fatalf("replayed events out of order: %d after %d", msg.Event.Seq, lastSeq)
+		}
+		lastSeq = msg.Event.Seq
+		if msg.Event.Status == jobs.StatusDone {
+			break
+		}
+	}
+}
+
+// enableWebhooks sets the webhook secret for the test and lets callbacks reach
+// the loopback receivers tests use
+func enableWebhooks(t *testing.T, secret string) {
+	jobs.WebhookSecret = []byte(secret)
+	jobs.AllowPrivateCallbacks = true
+	t.Cleanup(func() {
+		jobs.WebhookSecret = nil
+		jobs.AllowPrivateCallbacks = false
+	})
+}
+
+func TestWebhook(t *testing.T) {
+	_ = storage.EnsureStorage()
+	enableWebhooks(t, "s3cret")
+	t.Setenv("WEBHOOK_BACKOFF", "10ms")
+	ts := newTestServer()
+	defer ts.Close()
+
+	// The receiver fails twice before accepting the delivery
+	payloads := make(chan map[string]interface{}, 1)
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got := r.Header.Get(jobs.SignatureHeader); got != jobs.Sign([]byte("s3cret"), body) {
+			t.Errorf("bad signature %q", got)
+		}
+		if calls++; calls < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var payload map[string]interface{}
+		json.Unmarshal(body, &payload)
+		payloads <- payload
+	}))
+	defer receiver.Close()
+
+	id := uploadJob(t, ts, "test.csv", "name,email\nAlice,alice@example.com\n", map[string]string{
+		"callback_url": receiver.URL + "/hook",
+	})
+
+	select {
+	case payload := <-payloads:
+		if payload["job_id"] != id || payload["status"] != "DONE" || payload["stats"] == nil {
+			t.Errorf("unexpected payload: %v", payload)
+		}
+		if payload["download_url"] != ts.URL+"/api/download/"+id {
+			t.Errorf("unexpected download_url %v", payload["download_url"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	var webhook map[string]interface{}
+	for i := 0; i < 100; i++ {
+		status := waitForStatus(t, ts, id, "DONE")
+		webhook, _ = status["webhook"].(map[string]interface{})
+		if webhook != nil && webhook["delivered"] == true {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	attempts, _ := webhook["attempts"].([]interface{})
+	if webhook["delivered"] != true || len(attempts) != 3 {
+		t.Fatalf("expected delivery after 3 attempts, got %v", webhook)
+	}
+	if first := attempts[0].(map[string]interface{}); first["status_code"] != float64(500) || first["error"] == nil {
+		t.Errorf("unexpected failed attempt: %v", first)
+	}
+
+	// Only http and https callbacks are accepted
+	if code := uploadCallback(t, ts, "ftp://example.com/hook"); code != 400 {
+		t.Errorf("expected 400 for an invalid callback_url, got %d", code)
+	}
+}
+
+func TestResumeWebhooks(t *testing.T) {
+	enableWebhooks(t, "s3cret")
+	t.Setenv("WEBHOOK_BACKOFF", "10ms")
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "3")
+	payloads := make(chan map[string]interface{}, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		payloads <- payload
+	}))
+	defer receiver.Close()
+
+	// As reloaded from the job log after a restart: one delivery was cut short,
+	// another had used up its attempts and a third had succeeded
+	pending, exhausted, delivered := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	for id, w := range map[string]*jobs.Webhook{
+		pending:   {URL: receiver.URL, Remaining: 2, Attempts: []jobs.WebhookAttempt{{At: time.Now(), StatusCode: 500}}},
+		exhausted: {URL: receiver.URL},
+		delivered: {URL: receiver.URL, Delivered: true, Attempts: []jobs.WebhookAttempt{{At: time.Now(), StatusCode: 200}}},
+	} {
+		jobs.Jobs.Create(&jobs.Job{ID: id, Status: jobs.StatusFailed, Error: "boom", CreatedAt: time.Now(), Webhook: w})
+	}
+	if n := jobs.ResumeWebhooks(); n != 1 {
+		t.Fatalf("expected one delivery to resume, got %d", n)
+	}
+
+	select {
+	case payload := <-payloads:
+		if payload["job_id"] != pending || payload["status"] != "FAILED" {
+			t.Errorf("unexpected payload: %v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	for i := 0; ; i++ {
+		j, _ := jobs.Jobs.Snapshot(pending)
+		if j.Webhook.Delivered {
+			if j.Webhook.Remaining != 0 || len(j.Webhook.Attempts) != 2 {
+				t.Errorf("unexpected webhook after resuming: %+v", j.Webhook)
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatalf("delivery not recorded: %+v", j.Webhook)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case payload := <-payloads:
+		t.Errorf("unexpected delivery: %v", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func uploadCallback(t *testing.T, ts *httptest.Server, callback string) int {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("callback_url", callback)
+	part, _ := writer.CreateFormFile("file", "test.csv")
+	io.WriteString(part, "name,email\n")
+	writer.Close()
+	res, err := http.Post(ts.URL+"/api/upload", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestWebhook_RefusedCallbacks(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	// Without a secret the payload could not be signed
+	if code := uploadCallback(t, ts, "https://example.com/hook"); code != 400 {
+		t.Errorf("expected 400 without WEBHOOK_SECRET, got %d", code)
+	}
+
+	jobs.WebhookSecret = []byte("s3cret")
+	t.Cleanup(func() { jobs.WebhookSecret = nil })
+	for _, callback := range []string{
+		"http://127.0.0.1:9/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+	} {
+		if code := uploadCallback(t, ts, callback); code != 400 {
+			t.Errorf("expected 400 for callback %s, got %d", callback, code)
+		}
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	_ = storage.EnsureStorage()
+	t.Setenv("MAX_CONCURRENT_JOBS", "1")
+	t.Setenv("MAX_QUEUED_JOBS", "1")
+	ts := newTestServer()
+	defer ts.Close()
+
+	// The first job takes the only slot and the second waits for it
+	content := "name,email\n" + strings.Repeat("Alice,alice@example.com\n", 800000)
+	running := uploadJob(t, ts, "big.csv", content, nil)
+	waitForStatus(t, ts, running, "IN_PROGRESS")
+	waiting := uploadJob(t, ts, "test.csv", "name,email\nAlice,alice@example.com\n", nil)
+	status := waitForStatus(t, ts, waiting, "QUEUED")
+	if status["queue_position"] != float64(1) {
+		t.Errorf("expected queue position 1, got %v", status["queue_position"])
+	}
+
+	// Further uploads are turned away while the queue is full
+	body, contentType := createMultipartFile(t, "file", "test.csv", "name,email\n")
+	res, err := http.Post(ts.URL+"/api/upload", contentType, body)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After for a full queue, got %d", res.StatusCode)
+	}
+
+	// Cancelling the running job lets the waiting one start
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/jobs/"+running, nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("cancel failed: %v", err)
+	}
+	res.Body.Close()
+	status = waitForStatus(t, ts, waiting, "DONE")
+	if _, ok := status["queue_position"]; ok {
+		t.Errorf("finished job still reports a queue position: %v", status)
+	}
+
+	// A job cancelled while waiting leaves the queue and its files are removed
+	running = uploadJob(t, ts, "big.csv", content, nil)
+	waitForStatus(t, ts, running, "IN_PROGRESS")
+	waiting = uploadJob(t, ts, "test.csv", "name,email\n", nil)
+	req, _ = http.NewRequest(http.MethodDelete, ts.URL+"/api/jobs/"+waiting, nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("cancel failed: %v", err)
+	}
+	res.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(storage.StorageDir, waiting+storage.UploadSuffix)); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("queued job files were not cleaned up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	req, _ = http.NewRequest(http.MethodDelete, ts.URL+"/api/jobs/"+running, nil)
+	if res, err = http.DefaultClient.Do(req); err == nil {
+		res.Body.Close()
+	}
+}
+
+// uploadAs uploads a CSV on behalf of the client named by the X-User header
+func uploadAs(t *testing.T, ts *httptest.Server, user, content string, fields map[string]string) string {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	part, _ := writer.CreateFormFile("file", "test.csv")
+	io.WriteString(part, content)
+	writer.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("X-User", user)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	defer res.Body.Close()
+	var response map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&response)
+	id, ok := response["id"].(string)
+	if res.StatusCode != 200 || !ok {
+		t.Fatalf("upload returned %d: %v", res.StatusCode, response)
+	}
+	return id
+}
+
+func TestJobQueue_FairScheduling(t *testing.T) {
+	_ = storage.EnsureStorage()
+	t.Setenv("MAX_CONCURRENT_JOBS", "1")
+	ts := newTestServer()
+	defer ts.Close()
+
+	big := "name,email\n" + strings.Repeat("Alice,alice@example.com\n", 800000)
+	small := "name,email\nAlice,alice@example.com\n"
+	running := uploadAs(t, ts, "alice", big, nil)
+	waitForStatus(t, ts, running, "IN_PROGRESS")
+
+	// Alice's backlog does not hold back Bob, and her high priority job goes
+	// before her others
+	a1 := uploadAs(t, ts, "alice", small, nil)
+	a2 := uploadAs(t, ts, "alice", small, nil)
+	b1 := uploadAs(t, ts, "bob", small, map[string]string{"priority": "normal"})
+	a3 := uploadAs(t, ts, "alice", small, map[string]string{"priority": "high"})
+	want := []string{b1, a3, a1, a2}
+	for i, id := range want {
+		status := waitForStatus(t, ts, id, "QUEUED")
+		if status["queue_position"] != float64(i+1) {
+			t.Errorf("job %d: expected queue position %d, got %v", i, i+1, status["queue_position"])
+		}
+		if status["client"] == nil || status["priority"] == nil {
+			t.Errorf("status does not report client and priority: %v", status)
+		}
+	}
+
+	for _, id := range append(want, running) {
+		req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/jobs/"+id, nil)
+		if res, err := http.DefaultClient.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}
+}
+
+func TestJobQueue_HighPriorityFloodIsFair(t *testing.T) {
+	_ = storage.EnsureStorage()
+	t.Setenv("MAX_CONCURRENT_JOBS", "1")
+	ts := newTestServer()
+	defer ts.Close()
+
+	big := "name,email\n" + strings.Repeat("Alice,alice@example.com\n", 800000)
+	small := "name,email\nAlice,alice@example.com\n"
+	running := uploadAs(t, ts, "alice", big, nil)
+	waitForStatus(t, ts, running, "IN_PROGRESS")
+
+	// Marking every upload high priority does not put Alice ahead of Bob
+	high := map[string]string{"priority": "high"}
+	a1 := uploadAs(t, ts, "alice", small, high)
+	a2 := uploadAs(t, ts, "alice", small, high)
+	a3 := uploadAs(t, ts, "alice", small, high)
+	b1 := uploadAs(t, ts, "bob", small, map[string]string{"priority": "low"})
+	b2 := uploadAs(t, ts, "bob", small, map[string]string{"priority": "low"})
+	want := []string{b1, a1, b2, a2, a3}
+	for i, id := range want {
+		if status := waitForStatus(t, ts, id, "QUEUED"); status["queue_position"] != float64(i+1) {
+			t.Errorf("job %d: expected queue position %d, got %v", i, i+1, status["queue_position"])
+		}
+	}
+
+	for _, id := range append(want, running) {
+		req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/jobs/"+id, nil)
+		if res, err := http.DefaultClient.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}
+}
+
+func TestJobQueue_ClientLimit(t *testing.T) {
+	_ = storage.EnsureStorage()
+	t.Setenv("MAX_CONCURRENT_JOBS", "2")
+	t.Setenv("CLIENT_JOB_LIMITS", "alice=1")
+	ts := newTestServer()
+	defer ts.Close()
+
+	// Alice may only run one job even though a slot is free
+	big := "name,email\n" + strings.Repeat("Alice,alice@example.com\n", 800000)
+	first := uploadAs(t, ts, "alice", big, nil)
+	waitForStatus(t, ts, first, "IN_PROGRESS")
+	second := uploadAs(t, ts, "alice", big, nil)
+	bob := uploadAs(t, ts, "bob", "name,email\nBob,bob@example.com\n", nil)
+	waitForStatus(t, ts, bob, "DONE")
+	if status := waitForStatus(t, ts, second, "QUEUED"); status["queue_position"] != float64(1) {
+		t.Errorf("expected alice's second job to wait, got %v", status)
+	}
+
+	for _, id := range []string{second, first} {
+		req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/jobs/"+id, nil)
+		if res, err := http.DefaultClient.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}
+}
+
+func TestUpload_InvalidPriority(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("priority", "urgent")
+	part, _ := writer.CreateFormFile("file", "test.csv")
+	io.WriteString(part, "name,email\n")
+	writer.Close()
+	res, err := http.Post(ts.URL+"/api/upload", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("expected 400 for an invalid priority, got %d", res.StatusCode)
+	}
+}
+
+func TestRetryJob(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	// An empty upload fails the same way every time, so it is not retried
+	id := uploadJob(t, ts, "empty.csv", "", nil)
+	status := waitForStatus(t, ts, id, "FAILED")
+	attempts, _ := status["attempts"].([]interface{})
+	if len(attempts) != 1 {
+		t.Fatalf("expected one attempt, got %v", status["attempts"])
+	}
+	if a := attempts[0].(map[string]interface{}); a["error"] == nil || a["retryable"] == true {
+		t.Errorf("unexpected attempt: %v", a)
+	}
+
+	retry := func(id string) *http.Response {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/api/jobs/"+id+"/retry", "", nil)
+		if err != nil {
+			t.Fatalf("retry failed: %v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// A manual retry runs the stored upload again
+	if res := retry(id); res.StatusCode != 200 {
+		t.Fatalf("retry returned %d", res.StatusCode)
+	}
+	var last map[string]interface{}
+	for i := 0; i < 100; i++ {
+		status = waitForStatus(t, ts, id, "FAILED")
+		if attempts, _ = status["attempts"].([]interface{}); len(attempts) == 2 {
+			last = attempts[1].(map[string]interface{})
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if last == nil || last["manual"] != true {
+		t.Fatalf("expected a second, manual attempt: %v", status["attempts"])
+	}
+
+	// Only failed jobs with their upload still around can be retried
+	done := uploadJob(t, ts, "test.csv", "name,email\nAlice,alice@example.com\n", nil)
+	waitForStatus(t, ts, done, "DONE")
+	if res := retry(done); res.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409 retrying a finished job, got %d", res.StatusCode)
+	}
+	os.Remove(filepath.Join(storage.StorageDir, id+storage.UploadSuffix))
+	if res := retry(id); res.StatusCode != http.StatusGone {
+		t.Errorf("expected 410 once the upload is gone, got %d", res.StatusCode)
+	}
+}
+
+func TestRetryJob_TransientFailure(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("needs /dev/full to simulate a full disk")
+	}
+	_ = storage.EnsureStorage()
+	t.Setenv("MAX_CONCURRENT_JOBS", "1")
+	t.Setenv("JOB_RETRY_BACKOFF", "10ms")
+	ts := newTestServer()
+	defer ts.Close()
+
+	// Hold the only slot while the second job's output is pointed at a full disk
+	big := "name,email\n" + strings.Repeat("Alice,alice@example.com\n", 800000)
+	blocker := uploadJob(t, ts, "big.csv", big, nil)
+	waitForStatus(t, ts, blocker, "IN_PROGRESS")
+	id := uploadJob(t, ts, "test.csv", "name,email\nAlice,alice@example.com\n", nil)
+	if err := os.Symlink("/dev/full", storage.GetProcessedFilePath(id)); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/jobs/"+blocker, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("cancel failed: %v", err)
+	}
+	res.Body.Close()
+
+	// The failed write removes the link, so the automatic retry succeeds
+	status := waitForStatus(t, ts, id, "DONE")
+	attempts, _ := status["attempts"].([]interface{})
+	if len(attempts) != 2 {
+		t.Fatalf("expected two attempts, got %v", status["attempts"])
+	}
+	if first := attempts[0].(map[string]interface{}); first["retryable"] != true || first["error"] == nil {
+		t.Errorf("unexpected first attempt: %v", first)
+	}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	_ = storage.EnsureStorage()
+	var b strings.Builder
+	b.WriteString("name,email\n")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, "user%d,user%d@example.com\n", i, i)
+	}
+	input := b.String()
+
+	// A complete run gives the expected output and a checkpoint part way in
+	var full bytes.Buffer
+	var cp transform.Checkpoint
+	var cpSize int
+	opts := transform.Options{CheckpointInterval: int64(len(input) / 2), Checkpoint: func(c transform.Checkpoint) {
+		cp, cpSize = c, full.Len()
+	}}
+	rr, _ := transform.NewReader(transform.FormatCSV, strings.NewReader(input))
+	if err := transform.TransformSequentialWithOptions(rr, transform.NewCSVWriter(&full), opts); err != nil {
+		t.Fatal(err)
+	}
+	if cp.InputOffset == 0 {
+		t.Fatal("no checkpoint was taken")
+	}
+
+	// Leave things as a crash after the checkpoint would: rows past it were
+	// written and the job was still running
+	id := uuid.NewString()
+	inPath := filepath.Join(storage.StorageDir, id+storage.UploadSuffix)
+	os.WriteFile(inPath, []byte(input), 0o644)
+	partial := append(append([]byte{}, full.Bytes()[:cpSize]...), "half a row,tr"...)
+	os.WriteFile(storage.GetProcessedFilePath(id), partial, 0o644)
+	defer storage.CleanupJobFiles(id)
+
+	// As reloaded from the job log after a restart
+	jobs.Jobs.Create(&jobs.Job{
+		ID: id, Status: jobs.StatusQueued, InputPath: inPath, CreatedAt: time.Now(),
+		Mode: "sequential", Workers: 1, InputFormat: transform.FormatCSV, OutputFormat: transform.FormatCSV,
+		Checkpoint: &jobs.Checkpoint{Checkpoint: cp, OutputSize: int64(cpSize), At: time.Now()},
+	})
+	if n := jobs.ResumeInterrupted(); n != 1 {
+		t.Fatalf("expected one job to resume, got %d", n)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j, _ := jobs.Jobs.Snapshot(id)
+		if j.Status == jobs.StatusDone {
+			if j.Checkpoint != nil {
+				t.Error("checkpoint should be cleared once the job is done")
+			}
+			if j.Progress == nil || j.Progress.RowsProcessed != 5000 {
+				t.Errorf("unexpected progress after resume: %+v", j.Progress)
+			}
+			break
+		}
+		if j.Status.Terminal() || time.Now().After(deadline) {
+			t.Fatalf("job did not complete: %+v", j)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got, _ := os.ReadFile(storage.GetProcessedFilePath(id))
+	if !bytes.Equal(got, full.Bytes()) {
+		t.Error("resumed output differs from a complete run")
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	tag := uuid.NewString()
+	var ids []string
+	for range 3 {
+		id := uploadJob(t, ts, "test.csv", "name,email\nAlice,alice@example.com\n", map[string]string{"tags": tag + ",listed"})
+		waitForStatus(t, ts, id, "DONE")
+		ids = append(ids, id)
+	}
+
+	// list fetches one page of jobs
+	list := func(query string) (int, []string, string) {
+		res, err := http.Get(ts.URL + "/api/jobs?" + query)
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		defer res.Body.Close()
+		var page struct {
+			Jobs []struct {
+				ID string `json:"id"`
+			} `json:"jobs"`
+			NextCursor string `json:"next_cursor"`
+		}
+		json.NewDecoder(res.Body).Decode(&page)
+		var got []string
+		for _, j := range page.Jobs {
+			got = append(got, j.ID)
+		}
+		return res.StatusCode, got, page.NextCursor
+	}
+
+	// Newest first, two at a time
+	code, got, cursor := list("tag=" + tag + "&tag=listed&status=done&limit=2")
+	if code != http.StatusOK || len(got) != 2 || got[0] != ids[2] || got[1] != ids[1] || cursor == "" {
+		t.Fatalf("unexpected first page: %d %v %q", code, got, cursor)
+	}
+	_, got, cursor = list("tag=" + tag + "&status=done&limit=2&cursor=" + cursor)
+	if len(got) != 1 || got[0] != ids[0] || cursor != "" {
+		t.Fatalf("unexpected last page: %v %q", got, cursor)
+	}
+
+	_, got, _ = list("tag=" + tag + "&sort=created_at&mode=sequential")
+	if len(got) != 3 || got[0] != ids[0] {
+		t.Errorf("expected oldest first, got %v", got)
+	}
+	if _, got, _ = list("tag=" + tag + "&status=failed,cancelled"); len(got) != 0 {
+		t.Errorf("expected no failed jobs, got %v", got)
+	}
+	after := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if _, got, _ = list("tag=" + tag + "&created_after=" + after); len(got) != 0 {
+		t.Errorf("expected no jobs created in the future, got %v", got)
+	}
+
+	for _, query := range []string{"status=bogus", "mode=bogus", "created_after=yesterday", "sort=name", "limit=0", "cursor=bogus"} {
+		if code, _, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+}
+
+func TestUpload_FileDetailsAndLabels(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	content := "name,email\nAlice,alice@example.com\n"
+	team := uuid.NewString()
+	id := uploadJob(t, ts, `C:\Users\alice\Customers List.csv`, content, map[string]string{
+		"labels":   "team=" + team + ", env=prod",
+		"metadata": `{"source":"crm","batch":7}`,
+	})
+	status := waitForStatus(t, ts, id, "DONE")
+	sum := sha256.Sum256([]byte(content))
+	if status["filename"] != "Customers List.csv" || status["size"] != float64(len(content)) || status["sha256"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected file details: %v %v %v", status["filename"], status["size"], status["sha256"])
+	}
+	labels, _ := status["labels"].(map[string]interface{})
+	metadata, _ := status["metadata"].(map[string]interface{})
+	if labels["team"] != team || labels["env"] != "prod" || metadata["source"] != "crm" || metadata["batch"] != float64(7) {
+		t.Errorf("unexpected labels or metadata: %v %v", labels, metadata)
+	}
+
+	// Downloads are named after the original upload
+	for accept, want := range map[string]string{"": "Customers List.flagged.csv", "application/json": "Customers List.flagged.json"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/download/"+id, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("download failed: %v", err)
+		}
+		res.Body.Close()
+		_, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition"))
+		if err != nil || params["filename"] != want {
+			t.Errorf("expected download named %q, got %q", want, res.Header.Get("Content-Disposition"))
+		}
+	}
+
+	// Jobs can be listed by label
+	other := uploadJob(t, ts, "test.csv", content, map[string]string{"labels": "team=" + team + ",env=dev"})
+	waitForStatus(t, ts, other, "DONE")
+	res, err := http.Get(ts.URL + "/api/jobs?label=team=" + team + "&label=env=prod")
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	var page struct {
+		Jobs []map[string]interface{} `json:"jobs"`
+	}
+	json.NewDecoder(res.Body).Decode(&page)
+	res.Body.Close()
+	if len(page.Jobs) != 1 || page.Jobs[0]["id"] != id {
+		t.Errorf("expected only %s for its labels, got %v", id, page.Jobs)
+	}
+
+	for _, fields := range []map[string]string{
+		{"labels": "team"},
+		{"labels": "=x"},
+		{"labels": "a=1,a=2"},
+		{"metadata": "[1,2]"},
+		{"metadata": "{"},
+		{"metadata": `{"note":"` + strings.Repeat("x", jobs.MaxMetadataBytes) + `"}`},
+	} {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for k, v := range fields {
+			writer.WriteField(k, v)
+		}
+		part, _ := writer.CreateFormFile("file", "test.csv")
+		io.WriteString(part, content)
+		writer.Close()
+		res, err := http.Post(ts.URL+"/api/upload", writer.FormDataContentType(), body)
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", fields, res.StatusCode)
+		}
+	}
+}
+
+// uploadIdempotent posts content for user with the idempotency key, if any, and
+// the form fields
+func uploadIdempotent(t *testing.T, ts *httptest.Server, user, key, content string, fields map[string]string) (int, map[string]interface{}) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	part, _ := writer.CreateFormFile("file", "test.csv")
+	io.WriteString(part, content)
+	writer.Close()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("X-User", user)
+	if key != "" {
+		req.Header.Set(jobs.IdempotencyKeyHeader, key)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	defer res.Body.Close()
+	var response map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&response)
+	return res.StatusCode, response
+}
+
+func TestUpload_Idempotency(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	upload := func(user, key, content string, fields map[string]string) (int, map[string]interface{}) {
+		t.Helper()
+		return uploadIdempotent(t, ts, user, key, content, fields)
+	}
+
+	// A retried upload gets the job of the first attempt
+	content := "name,email\nAlice,alice@example.com\n" + uuid.NewString() + ",x\n"
+	key := uuid.NewString()
+	code, first := upload("etl", key, content, nil)
+	if code != http.StatusOK || first["existing"] != nil {
+		t.Fatalf("first upload returned %d: %v", code, first)
+	}
+	code, again := upload("etl", key, content, nil)
+	if code != http.StatusOK || again["id"] != first["id"] || again["existing"] != true {
+		t.Errorf("expected the retried upload to return job %v, got %d: %v", first["id"], code, again)
+	}
+	status := waitForStatus(t, ts, first["id"].(string), "DONE")
+	if status["idempotency_key"] != key {
+		t.Errorf("expected idempotency key in status, got %v", status["idempotency_key"])
+	}
+
+	// The key cannot be reused for another file, but another client may use it
+	if code, _ := upload("etl", key, content+"Bob,bob@example.com\n", nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a reused key, got %d", code)
+	}
+	if _, other := upload("other", key, content, nil); other["id"] == first["id"] || other["existing"] != nil {
+		t.Errorf("expected a new job for another client, got %v", other)
+	}
+
+	// Deduplication matches the content and the options that shape the output
+	if _, dup := upload("etl", "", content, map[string]string{"dedupe": "true", "tags": "ignored"}); dup["id"] != first["id"] || dup["existing"] != true {
+		t.Errorf("expected dedupe to return job %v, got %v", first["id"], dup)
+	}
+	if _, dup := upload("etl", "", content, map[string]string{"dedupe": "true", "lenient": "true"}); dup["id"] == first["id"] {
+		t.Errorf("expected a new job for different options, got %v", dup)
+	}
+	if _, dup := upload("etl", "", content, nil); dup["id"] == first["id"] {
+		t.Errorf("expected a new job without dedupe, got %v", dup)
+	}
+
+	if code, _ := upload("etl", "", content, map[string]string{"dedupe": "maybe"}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid dedupe value, got %d", code)
+	}
+	if code, _ := upload("etl", strings.Repeat("k", 256), content, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a long idempotency key, got %d", code)
+	}
+
+	// A callback is only accepted if the job serving the upload already has it
+	enableWebhooks(t, "s3cret")
+	hook := map[string]string{"callback_url": "http://127.0.0.1:9/hook"}
+	if code, _ := upload("etl", key, content, hook); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a callback on a job without one, got %d", code)
+	}
+	if code, _ := upload("etl", "", content, map[string]string{"dedupe": "true", "callback_url": hook["callback_url"]}); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a callback on a deduplicated upload, got %d", code)
+	}
+	hooked := content + "Carol,carol@example.com\n"
+	hookKey := uuid.NewString()
+	_, created := upload("etl", hookKey, hooked, hook)
+	if _, again := upload("etl", hookKey, hooked, hook); again["id"] != created["id"] {
+		t.Errorf("expected a retry with the same callback to return job %v, got %v", created["id"], again)
+	}
+	if code, _ := upload("etl", hookKey, hooked, map[string]string{"callback_url": "http://127.0.0.1:10/hook"}); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a retry with another callback, got %d", code)
+	}
+}
+
+func TestUpload_IdempotentRetryWithFullQueue(t *testing.T) {
+	_ = storage.EnsureStorage()
+	t.Setenv("MAX_CONCURRENT_JOBS", "1")
+	t.Setenv("MAX_QUEUED_JOBS", "1")
+	ts := newTestServer()
+	defer ts.Close()
+
+	content := "name,email\n" + strings.Repeat("Alice,alice@example.com\n", 800000)
+	running := uploadJob(t, ts, "big.csv", content, nil)
+	waitForStatus(t, ts, running, "IN_PROGRESS")
+	key := uuid.NewString()
+	code, waiting := uploadIdempotent(t, ts, "etl", key, "name,email\n"+key+",x\n", nil)
+	if code != http.StatusOK {
+		t.Fatalf("upload returned %d: %v", code, waiting)
+	}
+
+	// The queue is full, but a retry needs no place in it
+	code, again := uploadIdempotent(t, ts, "etl", key, "name,email\n"+key+",x\n", nil)
+	if code != http.StatusOK || again["id"] != waiting["id"] || again["existing"] != true {
+		t.Errorf("expected the retry to return job %v, got %d: %v", waiting["id"], code, again)
+	}
+	if code, _ := uploadIdempotent(t, ts, "etl", uuid.NewString(), "name,email\n", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for a new upload, got %d", code)
+	}
+
+	for _, id := range []string{waiting["id"].(string), running} {
+		req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/jobs/"+id, nil)
+		if res, err := http.DefaultClient.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}
+}
+
+func TestBatchUpload_TooLarge(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+	t.Setenv("MAX_BATCH_FILE_BYTES", "1024")
+	t.Setenv("MAX_BATCH_BYTES", "1536")
+
+	// zipped compresses the files well below the limits
+	zipped := func(files map[string]string) []byte {
+		var archive bytes.Buffer
+		zw := zip.NewWriter(&archive)
+		for name, content := range files {
+			f, _ := zw.Create(name)
+			io.WriteString(f, content)
+		}
+		zw.Close()
+		return archive.Bytes()
+	}
+	rows := "name,email\n" + strings.Repeat("Alice,alice@example.com\n", 50)
+
+	for name, archive := range map[string][]byte{
+		"large file":  zipped(map[string]string{"a.csv": rows, "b.csv": "name,email\n"}),
+		"large batch": zipped(map[string]string{"a.csv": rows[:1000], "b.csv": rows[:1000]}),
+	} {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "batch.zip")
+		part.Write(archive)
+		writer.Close()
+		res, err := http.Post(ts.URL+"/api/upload", writer.FormDataContentType(), body)
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: expected 413, got %d", name, res.StatusCode)
+		}
+	}
+}
+
+func TestBatchUpload(t *testing.T) {
+	_ = storage.EnsureStorage()
+	ts := newTestServer()
+	defer ts.Close()
+
+	// A zip holding two files, one in a folder, and entries that are skipped
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for name, content := range map[string]string{
+		"people.csv":            "name,email\nAlice,alice@example.com\nBob,bob\n",
+		"more/people.csv":       "name,email\nCarol,carol@example.org\n",
+		"more/":                 "",
+		".DS_Store":             "junk",
+		"__MACOSX/._people.csv": "junk",
+	} {
+		f, _ := zw.Create(name)
+		io.WriteString(f, content)
+	}
+	zw.Close()
+
+	// upload posts the files as parts named "file"
+	upload := func(files map[string][]byte, fields map[string]string) (int, map[string]interface{}) {
+		t.Helper()
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for k, v := range fields {
+			writer.WriteField(k, v)
+		}
+		for name, content := range files {
+			part, _ := writer.CreateFormFile("file", name)
+			part.Write(content)
+		}
+		writer.Close()
+		res, err := http.Post(ts.URL+"/api/upload", writer.FormDataContentType(), body)
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+		defer res.Body.Close()
+		var response map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&response)
+		return res.StatusCode, response
+	}
+
+	code, response := upload(map[string][]byte{
+		"batch.zip":  archive.Bytes(),
+		"extra.csv":  []byte("name,email\nDave,dave@example.com\n"),
+		"broken.csv": []byte("name,email\n\"unterminated\n"),
+	}, map[string]string{"tags": "batched"})
+	batchID, _ := response["batch_id"].(string)
+	children, _ := response["jobs"].([]interface{})
+	if code != http.StatusOK || batchID == "" || len(children) != 4 {
+		t.Fatalf("batch upload returned %d: %v", code, response)
+	}
+
+	// getBatch fetches the batch status once every job has finished
+	var batch struct {
+		Status string         `json:"status"`
+		Counts map[string]int `json:"counts"`
+		Files  []struct {
+			Name  string `json:"name"`
+			Size  int64  `json:"size"`
+			JobID string `json:"job_id"`
+		} `json:"files"`
+		Stats struct {
+			RowsRead      int `json:"rows_read"`
+			RowsWithEmail int `json:"rows_with_email"`
+			TopDomains    []struct {
+				Domain string `json:"domain"`
+				Count  int    `json:"count"`
+			} `json:"top_domains"`
+			TopDomainsApproximate bool `json:"top_domains_approximate"`
+		} `json:"stats"`
+		Jobs []struct {
+			ID       string   `json:"id"`
+			BatchID  string   `json:"batch_id"`
+			Filename string   `json:"filename"`
+			Tags     []string `json:"tags"`
+		} `json:"jobs"`
+	}
+	for i := 0; ; i++ {
+		res, err := http.Get(ts.URL + "/api/batches/" + batchID)
+		if err != nil {
+			t.Fatalf("batch status failed: %v", err)
+		}
+		json.NewDecoder(res.Body).Decode(&batch)
+		res.Body.Close()
+		if batch.Status != "QUEUED" && batch.Status != "IN_PROGRESS" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("batch did not finish: %+v", batch)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if batch.Status != "DONE_WITH_ERRORS" || batch.Counts["DONE"] != 3 || batch.Counts["FAILED"] != 1 {
+		t.Errorf("unexpected batch status: %s %v", batch.Status, batch.Counts)
+	}
+	if batch.Stats.RowsRead != 4 || batch.Stats.RowsWithEmail != 3 ||
+		len(batch.Stats.TopDomains) != 2 || batch.Stats.TopDomains[0].Domain != "example.com" || batch.Stats.TopDomains[0].Count != 2 ||
+		!batch.Stats.TopDomainsApproximate {
+		t.Errorf("unexpected batch stats: %+v", batch.Stats)
+	}
+
+	// The batch keeps its own record of the files it was given
+	if len(batch.Files) != 4 {
+		t.Fatalf("expected 4 files in the batch record, got %+v", batch.Files)
+	}
+	for i, f := range batch.Files {
+		if f.JobID != batch.Jobs[i].ID || f.Name != batch.Jobs[i].Filename || f.Size == 0 {
+			t.Errorf("file %d does not match its job: %+v", i, f)
+		}
+	}
+	if _, err := os.Stat(storage.GetBatchFilePath(batchID)); err != nil {
+		t.Errorf("batch record not saved: %v", err)
+	}
+	for _, j := range batch.Jobs {
+		if j.BatchID != batchID || len(j.Tags) != 1 || j.Tags[0] != "batched" {
+			t.Errorf("job %s does not carry the batch and options: %+v", j.ID, j)
+		}
+	}
+
+	// The download bundles the outputs, with duplicate names made unique
+	res, err := http.Get(ts.URL + "/api/batches/" + batchID + "/download")
+	if err != nil {
+		t.Fatalf("batch download failed: %v", err)
+	}
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("batch download returned %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("batch download is not a zip: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		rc, _ := f.Open()
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		if !strings.HasPrefix(string(content), "name,email,hasEmail\n") {
+			t.Errorf("%s does not hold flagged output: %q", f.Name, content)
+		}
+	}
+	slices.Sort(names)
+	if want := []string{"extra.flagged.csv", "people (2).flagged.csv", "people.flagged.csv"}; !slices.Equal(names, want) {
+		t.Errorf("expected entries %v, got %v", want, names)
+	}
+
+	// Jobs of a batch can be listed
+	res, err = http.Get(ts.URL + "/api/jobs?batch=" + batchID)
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	var page struct {
+		Jobs []map[string]interface{} `json:"jobs"`
+	}
+	json.NewDecoder(res.Body).Decode(&page)
+	res.Body.Close()
+	if len(page.Jobs) != 4 {
+		t.Errorf("expected 4 jobs in the batch listing, got %d", len(page.Jobs))
+	}
+
+	// A missing output is reported before the download starts
+	for _, j := range batch.Jobs {
+		if j.Filename == "extra.csv" {
+			os.Remove(storage.GetProcessedFilePath(j.ID))
+		}
+	}
+	res, err = http.Get(ts.URL + "/api/batches/" + batchID + "/download")
+	if err != nil {
+		t.Fatalf("batch download failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound || res.Header.Get("Content-Type") == "application/zip" {
+		t.Errorf("expected 404 for a missing output, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	for name, fields := range map[string]map[string]string{
+		"invalid option": {"long_rows": "bogus"},
+		"dedupe":         {"dedupe": "true"},
+	} {
+		if code, _ := upload(map[string][]byte{"a.csv": []byte("a\n"), "b.csv": []byte("b\n")}, fields); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", name, code)
+		}
+	}
+	if code, _ := upload(map[string][]byte{"bad.zip": []byte("not a zip")}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid zip, got %d", code)
+	}
+	if res, err := http.Get(ts.URL + "/api/batches/" + uuid.NewString()); err == nil {
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400 for an unknown batch, got %d", res.StatusCode)
+		}
+	}
+}
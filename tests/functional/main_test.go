@@ -0,0 +1,24 @@
+package functional
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"csv-email-flagger/internal/storage"
+)
+
+// TestMain keeps the files written by jobs out of the source tree. The
+// directory is shared by all tests, as jobs may still be cleaning up after
+// the test that started them has returned.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "csv-email-flagger-functional-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	storage.StorageDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,96 @@
+package unit
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"csv-email-flagger/internal/transform"
+)
+
+func TestTransform_ResumesFromCheckpoint(t *testing.T) {
+	const rows = 20000
+	var b strings.Builder
+	b.WriteString("id,note,email\n")
+	for i := 1; i <= rows; i++ {
+		switch {
+		case i%500 == 0:
+			b.WriteString(",,\n")
+		case i%7 == 0:
+			fmt.Fprintf(&b, "%d,\"multi\nline\",user%d@example.com\n", i, i)
+		default:
+			fmt.Fprintf(&b, "%d,plain,user%d\n", i, i)
+		}
+	}
+	input := b.String()
+
+	// run transforms input from the offset of resume, if set, into out
+	runs := map[string]func(out *bytes.Buffer, opts transform.Options) error{
+		"sequential": func(out *bytes.Buffer, opts transform.Options) error {
+			rr, _ := transform.NewReader(transform.FormatCSV, strings.NewReader(input[resumeOffset(opts):]))
+			return transform.TransformSequentialWithOptions(rr, transform.NewCSVWriter(out), opts)
+		},
+		"parallel": func(out *bytes.Buffer, opts transform.Options) error {
+			opts.BatchSize = 64
+			rr, _ := transform.NewReader(transform.FormatCSV, strings.NewReader(input[resumeOffset(opts):]))
+			return transform.TransformParallelWithOptions(rr, transform.NewCSVWriter(out), 4, opts)
+		},
+		"chunked": func(out *bytes.Buffer, opts transform.Options) error {
+			opts.ChunkSize = 16 << 10
+			in := strings.NewReader(input)
+			in.Seek(resumeOffset(opts), 0)
+			return transform.TransformChunked(in, transform.NewCSVWriter(out), 4, opts)
+		},
+	}
+	for name, run := range runs {
+		type saved struct {
+			cp   transform.Checkpoint
+			size int
+		}
+		var full bytes.Buffer
+		var checkpoints []saved
+		opts := transform.Options{
+			CheckpointInterval: 32 << 10,
+			Checkpoint: func(cp transform.Checkpoint) {
+				checkpoints = append(checkpoints, saved{cp, full.Len()})
+			},
+		}
+		if err := run(&full, opts); err != nil {
+			t.Fatalf("%s: transform failed: %v", name, err)
+		}
+		if len(checkpoints) < 3 {
+			t.Fatalf("%s: expected periodic checkpoints, got %d", name, len(checkpoints))
+		}
+		for i, s := range checkpoints {
+			if s.cp.HeaderWidth != 3 || s.cp.InputOffset <= 0 || s.cp.InputOffset >= int64(len(input)) ||
+				(i > 0 && s.cp.InputOffset <= checkpoints[i-1].cp.InputOffset) {
+				t.Fatalf("%s: unexpected checkpoint %+v", name, s.cp)
+			}
+		}
+
+		// Resuming from any checkpoint completes the same output
+		for _, s := range []saved{checkpoints[0], checkpoints[len(checkpoints)/2], checkpoints[len(checkpoints)-1]} {
+			resumed := bytes.NewBuffer(append([]byte{}, full.Bytes()[:s.size]...))
+			cp := s.cp
+			var last transform.Progress
+			opts := transform.Options{Resume: &cp, Progress: func(p transform.Progress) { last = p }}
+			if err := run(resumed, opts); err != nil {
+				t.Fatalf("%s: resume from %d failed: %v", name, cp.InputOffset, err)
+			}
+			if !bytes.Equal(resumed.Bytes(), full.Bytes()) {
+				t.Errorf("%s: output resumed from %d differs from a full run", name, cp.InputOffset)
+			}
+			if last.Rows != rows || last.BytesRead != int64(len(input)) {
+				t.Errorf("%s: progress after resume should count from the start, got %+v", name, last)
+			}
+		}
+	}
+}
+
+func resumeOffset(opts transform.Options) int64 {
+	if opts.Resume == nil {
+		return 0
+	}
+	return opts.Resume.InputOffset
+}
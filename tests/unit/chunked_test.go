@@ -0,0 +1,109 @@
+package unit
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"csv-email-flagger/internal/transform"
+)
+
+// chunkedCSV has quoted fields spanning lines and containing doubled quotes, so
+// that small chunk sizes put many candidate split points inside quotes
+func chunkedCSV(rows int) string {
+	var b strings.Builder
+	b.WriteString("id,\"multi\nline header\",email\n")
+	for i := 1; i <= rows; i++ {
+		switch i % 5 {
+		case 0:
+			fmt.Fprintf(&b, "%d,\"note with \"\"quotes\"\"\nand a newline\",user%d@example.com\n", i, i)
+		case 1:
+			fmt.Fprintf(&b, "%d,\"a,b\r\nc\",none\r\n", i)
+		case 2:
+			fmt.Fprintf(&b, "%d,plain,\"quoted@example.com\"\n", i)
+		case 3:
+			b.WriteString("  , ,\n")
+		default:
+			fmt.Fprintf(&b, "%d,short\n", i)
+		}
+	}
+	return b.String()
+}
+
+func TestTransformChunked_MatchesSequential(t *testing.T) {
+	input := chunkedCSV(500)
+	var expected bytes.Buffer
+	seqStats := &transform.Stats{}
+	opts := transform.Options{PadShortRows: true, Stats: seqStats}
+	if err := transform.TransformSequentialWithOptions(transform.NewCSVReader(strings.NewReader(input)), transform.NewCSVWriter(&expected), opts); err != nil {
+		t.Fatalf("sequential transform failed: %v", err)
+	}
+
+	for _, chunkSize := range []int{1, 7, 64, 1000, 1 << 20} {
+		var out bytes.Buffer
+		stats := &transform.Stats{}
+		opts := transform.Options{PadShortRows: true, Stats: stats, ChunkSize: chunkSize}
+		if err := transform.TransformChunked(strings.NewReader(input), transform.NewCSVWriter(&out), 4, opts); err != nil {
+			t.Fatalf("chunk size %d: chunked transform failed: %v", chunkSize, err)
+		}
+		if out.String() != expected.String() {
+			t.Errorf("chunk size %d: output differs from sequential\nGot:\n%s\nWant:\n%s", chunkSize, out.String(), expected.String())
+		}
+		if stats.RowsRead != seqStats.RowsRead || stats.RowsWritten != seqStats.RowsWritten ||
+			stats.BlankRowsSkipped != seqStats.BlankRowsSkipped || stats.PaddedRows != seqStats.PaddedRows {
+			t.Errorf("chunk size %d: stats %+v do not match sequential %+v", chunkSize, *stats, *seqStats)
+		}
+	}
+}
+
+func TestTransformChunked_FallsBackForStreams(t *testing.T) {
+	input := chunkedCSV(50)
+	var expected, out bytes.Buffer
+	if err := transform.TransformSequential(strings.NewReader(input), &expected); err != nil {
+		t.Fatalf("sequential transform failed: %v", err)
+	}
+	// bytes.Buffer cannot be read at an offset
+	opts := transform.Options{ChunkSize: 16}
+	if err := transform.TransformChunked(bytes.NewBufferString(input), transform.NewCSVWriter(&out), 2, opts); err != nil {
+		t.Fatalf("chunked transform failed: %v", err)
+	}
+	if out.String() != expected.String() {
+		t.Errorf("unexpected output\nGot:\n%s\nWant:\n%s", out.String(), expected.String())
+	}
+}
+
+func TestTransformChunked_ReportsFirstErrorLine(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("name,email\n")
+	for i := 1; i <= 100; i++ {
+		if i == 40 {
+			// A bare quote throws the quote parity off for every later split
+			b.WriteString("bad \"row,x@example.com\n")
+			continue
+		}
+		fmt.Fprintf(&b, "user%d,user%d@example.com\n", i, i)
+	}
+
+	var out bytes.Buffer
+	opts := transform.Options{ChunkSize: 32}
+	err := transform.TransformChunked(strings.NewReader(b.String()), transform.NewCSVWriter(&out), 4, opts)
+	if err == nil {
+		t.Fatal("expected an error for the bare quote")
+	}
+	if !strings.Contains(err.Error(), "line 41") {
+		t.Errorf("expected the error on line 41, got %v", err)
+	}
+	seqErr := transform.TransformSequentialRecords(transform.NewCSVReader(strings.NewReader(b.String())), transform.NewCSVWriter(&out))
+	if seqErr == nil || err.Error() != seqErr.Error() {
+		t.Errorf("expected the sequential error %v, got %v", seqErr, err)
+	}
+}
+
+func TestTransformChunked_EmptyInput(t *testing.T) {
+	var out bytes.Buffer
+	err := transform.TransformChunked(strings.NewReader(""), transform.NewCSVWriter(&out), 2, transform.Options{})
+	if err == nil || !strings.Contains(err.Error(), "input appears to be empty or invalid") {
+		t.Fatalf("expected an empty input error, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"csv-email-flagger/internal/transform"
+)
+
+// endlessReader yields a header followed by rows forever
+type endlessReader struct {
+	n int
+}
+
+func (r *endlessReader) Read() ([]string, error) {
+	r.n++
+	if r.n == 1 {
+		return []string{"id", "email"}, nil
+	}
+	return []string{strconv.Itoa(r.n), fmt.Sprintf("user%d@example.com", r.n)}, nil
+}
+
+// failingWriter fails once it has been given limit records
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write([]string) error {
+	if w.limit--; w.limit < 0 {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func (w *failingWriter) Close() error { return nil }
+
+// checkNoLeak fails the test if goroutines started after baseline are still
+// running shortly after the transform returned
+func checkNoLeak(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines leaked\n%s", runtime.NumGoroutine()-baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTransformParallelContext_CancelStopsAllGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := transform.TransformParallelContext(ctx, &endlessReader{}, transform.NewCSVWriter(io.Discard), 4, transform.Options{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	checkNoLeak(t, baseline)
+}
+
+func TestTransformParallelContext_WriteErrorStopsAllGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	err := transform.TransformParallelContext(context.Background(), &endlessReader{}, &failingWriter{limit: 1000}, 4, transform.Options{Window: 64})
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	checkNoLeak(t, baseline)
+}
+
+func TestTransformSequentialContext_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := transform.TransformSequentialContext(ctx, &endlessReader{}, transform.NewCSVWriter(io.Discard), transform.Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = transform.TransformSequentialContext(ctx, &endlessReader{}, transform.NewCSVWriter(io.Discard), transform.Options{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestTransformChunkedContext_StopsAllGoroutines(t *testing.T) {
+	input := chunkedCSV(5000)
+
+	baseline := runtime.NumGoroutine()
+	err := transform.TransformChunkedContext(context.Background(), strings.NewReader(input), &failingWriter{limit: 100}, 4, transform.Options{ChunkSize: 256})
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	checkNoLeak(t, baseline)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = transform.TransformChunkedContext(ctx, strings.NewReader(input), transform.NewCSVWriter(io.Discard), 4, transform.Options{ChunkSize: 256})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	checkNoLeak(t, baseline)
+}
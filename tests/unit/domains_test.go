@@ -0,0 +1,82 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"testing"
+
+	"csv-email-flagger/internal/transform"
+)
+
+func domainReportRows(t *testing.T, in string, capacity int, parallel bool) [][]string {
+	t.Helper()
+	report := transform.NewDomainReport(capacity)
+	rr, _ := transform.NewReader(transform.FormatCSV, strings.NewReader(in))
+	var out bytes.Buffer
+	opts := transform.Options{Domains: report}
+	var err error
+	if parallel {
+		err = transform.TransformParallelWithOptions(rr, transform.NewCSVWriter(&out), 2, opts)
+	} else {
+		err = transform.TransformSequentialWithOptions(rr, transform.NewCSVWriter(&out), opts)
+	}
+	if err != nil {
+		t.Fatalf("transform failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteCSV(&buf); err != nil {
+		t.Fatalf("write report: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("report is not valid CSV: %v", err)
+	}
+	return rows
+}
+
+func TestDomainReport(t *testing.T) {
+	in := `name,email,alt
+Alice,alice@example.com,a2@example.com
+Bob,bob@test.org,
+Carol,carol@Example.com,
+Dan,not-an-email,
+Alice,alice@example.com,
+`
+	for _, parallel := range []bool{false, true} {
+		rows := domainReportRows(t, in, 0, parallel)
+		if len(rows) != 3 {
+			t.Fatalf("parallel=%v expected header and 2 domains, got %v", parallel, rows)
+		}
+		want := [][]string{
+			{"domain", "row_count", "distinct_addresses", "max_overcount", "example_1", "example_2", "example_3"},
+			{"example.com", "3", "3", "0", "Alice,alice@example.com,a2@example.com", "Carol,carol@Example.com,", "Alice,alice@example.com,"},
+			{"test.org", "1", "1", "0", "Bob,bob@test.org,", "", ""},
+		}
+		for i := range want {
+			if strings.Join(rows[i], "|") != strings.Join(want[i], "|") {
+				t.Errorf("parallel=%v row %d: got %q, want %q", parallel, i, rows[i], want[i])
+			}
+		}
+	}
+}
+
+func TestDomainReport_BoundedCapacity(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("name,email\n")
+	for i := 0; i < 200; i++ {
+		sb.WriteString("Top,user@popular.com\n")
+	}
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&sb, "Rare,user@rare%d.com\n", i)
+	}
+	rows := domainReportRows(t, sb.String(), 10, false)
+	if len(rows) != 11 {
+		t.Fatalf("expected report bounded to 10 domains, got %d rows", len(rows)-1)
+	}
+	if rows[1][0] != "popular.com" || rows[1][1] != "200" {
+		t.Errorf("expected the frequent domain to survive eviction, got %q", rows[1])
+	}
+}
@@ -0,0 +1,162 @@
+package unit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"csv-email-flagger/internal/jobs"
+)
+
+func TestFileStore_ReloadsJobs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jobs.log")
+	upload := filepath.Join(dir, "running.upload")
+	if err := os.WriteFile(upload, []byte("name,email\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := jobs.OpenFileStore(path, jobs.NewHub())
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	now := time.Now()
+	store.Create(&jobs.Job{ID: "done", Status: jobs.StatusQueued, InputPath: upload, CreatedAt: now, Tags: []string{"a"}})
+	store.Start("done")
+	store.Update("done", func(j *jobs.Job) { j.Output = filepath.Join(dir, "done.csv") })
+	store.SetStatus("done", jobs.StatusDone, nil)
+	store.Create(&jobs.Job{ID: "running", Status: jobs.StatusQueued, InputPath: upload, CreatedAt: now})
+	store.Start("running")
+	store.Create(&jobs.Job{ID: "lost", Status: jobs.StatusQueued, InputPath: filepath.Join(dir, "missing.upload"), CreatedAt: now})
+	store.Start("lost")
+	store.Create(&jobs.Job{ID: "cancelled", Status: jobs.StatusQueued, InputPath: upload, CreatedAt: now})
+	if _, err := store.Cancel("cancelled", "tester"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record cut short by a crash is ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"torn","status":"DO`)
+	f.Close()
+
+	store, err = jobs.OpenFileStore(path, jobs.NewHub())
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+
+	want := map[string]jobs.JobStatus{
+		"done":      jobs.StatusDone,
+		"running":   jobs.StatusQueued,
+		"lost":      jobs.StatusFailed,
+		"cancelled": jobs.StatusCancelled,
+	}
+	for id, status := range want {
+		j, ok := store.Snapshot(id)
+		if !ok {
+			t.Errorf("job %s was not reloaded", id)
+			continue
+		}
+		if j.Status != status {
+			t.Errorf("job %s: expected %s, got %s", id, status, j.Status)
+		}
+	}
+	if _, ok := store.Snapshot("torn"); ok {
+		t.Error("the torn record should be ignored")
+	}
+
+	done, _ := store.Snapshot("done")
+	if done.InputPath != upload || done.Output != filepath.Join(dir, "done.csv") || len(done.Tags) != 1 {
+		t.Errorf("job fields were not restored: %+v", done)
+	}
+	if lost, _ := store.Snapshot("lost"); lost.Error != jobs.ErrInterrupted.Error() {
+		t.Errorf("expected the interrupted error, got %q", lost.Error)
+	}
+	if c, _ := store.Snapshot("cancelled"); c.CancelledBy != "tester" {
+		t.Errorf("cancellation was not restored: %+v", c)
+	}
+
+	// The log is compacted to one record per job, and changes keep being saved
+	store.SetStatus("running", jobs.StatusFailed, errors.New("boom"))
+	store.Close()
+	store, err = jobs.OpenFileStore(path, jobs.NewHub())
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	if j, _ := store.Snapshot("running"); j.Status != jobs.StatusFailed || j.Error != "boom" {
+		t.Errorf("change after reload was not saved: %+v", j)
+	}
+	if n := len(store.List(func(*jobs.Job) bool { return true })); n != 4 {
+		t.Errorf("expected 4 jobs, got %d", n)
+	}
+}
+
+func TestFileStore_KeepsIdempotencyKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.log")
+	store, err := jobs.OpenFileStore(path, jobs.NewHub())
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	first := &jobs.Job{ID: "first", Status: jobs.StatusFailed, Client: "etl", IdempotencyKey: "k1", Fingerprint: "f1", CreatedAt: time.Now()}
+	if _, created, err := store.CreateUnique(first, false); !created || err != nil {
+		t.Fatalf("expected the first job to be created, got %v %v", created, err)
+	}
+	store.Close()
+
+	store, err = jobs.OpenFileStore(path, jobs.NewHub())
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	j, created, err := store.CreateUnique(&jobs.Job{ID: "retry", Client: "etl", IdempotencyKey: "k1", Fingerprint: "f1"}, false)
+	if created || err != nil || j.ID != "first" {
+		t.Errorf("expected the key to resolve to the first job after a restart, got %q %v %v", j.ID, created, err)
+	}
+	if _, _, err := store.CreateUnique(&jobs.Job{ID: "other", Client: "etl", IdempotencyKey: "k1", Fingerprint: "f2"}, false); !errors.Is(err, jobs.ErrIdempotencyKeyReused) {
+		t.Errorf("expected ErrIdempotencyKeyReused, got %v", err)
+	}
+	// A failed job is not reused by deduplication
+	if _, created, _ := store.CreateUnique(&jobs.Job{ID: "dedupe", Client: "etl", Fingerprint: "f1"}, true); !created {
+		t.Error("expected a failed job not to be reused")
+	}
+}
+
+func TestFileStore_CompactsWhileOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.log")
+	store, err := jobs.OpenFileStore(path, jobs.NewHub())
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	store.Create(&jobs.Job{ID: "busy", Status: jobs.StatusQueued, CreatedAt: time.Now()})
+	for i := 0; i < 5000; i++ {
+		store.Update("busy", func(j *jobs.Job) { j.MalformedRows = i })
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte{'\n'}); n > 1001 {
+		t.Errorf("expected the log to be compacted, it holds %d records", n)
+	}
+	store.Close()
+
+	store, err = jobs.OpenFileStore(path, jobs.NewHub())
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	if j, _ := store.Snapshot("busy"); j.MalformedRows != 4999 {
+		t.Errorf("expected the last change to survive compaction, got %d", j.MalformedRows)
+	}
+}
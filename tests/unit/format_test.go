@@ -0,0 +1,194 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"csv-email-flagger/internal/transform"
+)
+
+func transformFormats(t *testing.T, in string, inFormat, outFormat transform.Format, parallel bool) string {
+	t.Helper()
+	rr, err := transform.NewReader(inFormat, strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("new reader: %v", err)
+	}
+	var out bytes.Buffer
+	rw, err := transform.NewWriter(outFormat, &out)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	if parallel {
+		err = transform.TransformParallelRecords(rr, rw, 2)
+	} else {
+		err = transform.TransformSequentialRecords(rr, rw)
+	}
+	if err != nil {
+		t.Fatalf("transform failed: %v", err)
+	}
+	return out.String()
+}
+
+func TestTransform_NDJSONInput(t *testing.T) {
+	in := `{"name":"Alice","email":"alice@example.com"}
+{"email":"not-an-email","name":"Bob"}
+{"name":"Carol","email":null}
+`
+	expected := `name,email,hasEmail
+Alice,alice@example.com,true
+Bob,not-an-email,false
+Carol,,false
+`
+	for _, parallel := range []bool{false, true} {
+		got := transformFormats(t, in, transform.FormatNDJSON, transform.FormatCSV, parallel)
+		if got != expected {
+			t.Errorf("parallel=%v unexpected output\nGot:\n%s\nWant:\n%s", parallel, got, expected)
+		}
+	}
+}
+
+func TestTransform_NDJSONOutput(t *testing.T) {
+	expected := `{"name":"Alice","email":"alice@example.com","hasEmail":true}
+{"name":"Bob","email":"not-an-email","hasEmail":false}
+`
+	got := transformFormats(t, sampleCSV, transform.FormatCSV, transform.FormatNDJSON, false)
+	if got != expected {
+		t.Errorf("unexpected output\nGot:\n%s\nWant:\n%s", got, expected)
+	}
+}
+
+// Ragged rows keep the flag under hasEmail, and extra fields get their own keys
+func TestTransform_NDJSONRaggedRows(t *testing.T) {
+	cases := []struct{ in, expected string }{
+		{"a,b,c\nx@y.com\n", `{"a":"x@y.com","hasEmail":true}` + "\n"},
+		{"a,b\nx,y@z.com,extra\n", `{"a":"x","b":"y@z.com","column3":"extra","hasEmail":true}` + "\n"},
+		{"name,hasEmail\nbob,bar,extra\n", `{"name":"bob","hasEmail":false,"column3":"extra"}` + "\n"},
+		{"name,email,hasEmail\nbob@example.com\n", `{"name":"bob@example.com","hasEmail":true}` + "\n"},
+	}
+	for _, c := range cases {
+		for _, parallel := range []bool{false, true} {
+			got := transformFormats(t, c.in, transform.FormatCSV, transform.FormatNDJSON, parallel)
+			if got != c.expected {
+				t.Errorf("%q parallel=%v: unexpected output\nGot:\n%s\nWant:\n%s", c.in, parallel, got, c.expected)
+			}
+		}
+	}
+}
+
+func transformRaw(t *testing.T, in string, inFormat, outFormat transform.Format, parallel bool) string {
+	t.Helper()
+	rr, err := transform.NewRawReader(inFormat, strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("new reader: %v", err)
+	}
+	var out bytes.Buffer
+	rw, err := transform.NewRawWriter(outFormat, &out)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	opts := transform.Options{RawJSON: true}
+	if parallel {
+		err = transform.TransformParallelContext(context.Background(), rr, rw, 2, opts)
+	} else {
+		err = transform.TransformSequentialContext(context.Background(), rr, rw, opts)
+	}
+	if err != nil {
+		t.Fatalf("transform failed: %v", err)
+	}
+	return out.String()
+}
+
+func TestTransform_JSONArrayRoundTrip(t *testing.T) {
+	in := `[{"name":"Alice","email":"alice@example.com","age":30},{"name":"Bob","email":"bob","age":41}]`
+	expected := `[{"name":"Alice","email":"alice@example.com","age":30,"hasEmail":true},{"name":"Bob","email":"bob","age":41,"hasEmail":false}]
+`
+	got := transformRaw(t, in, transform.FormatJSON, transform.FormatJSON, true)
+	if got != expected {
+		t.Errorf("unexpected output\nGot:\n%s\nWant:\n%s", got, expected)
+	}
+}
+
+func TestTransform_JSONKeepsValueTypes(t *testing.T) {
+	in := `{"id":1,"active":true,"score":2.50,"note":null,"contact":{"email":"a@example.com"},"tags":["x", "y"]}
+{"id":2,"active":false}
+{"note":null}
+`
+	expected := `{"id":1,"active":true,"score":2.50,"note":null,"contact":{"email":"a@example.com"},"tags":["x","y"],"hasEmail":true}
+{"id":2,"active":false,"score":null,"note":null,"contact":null,"tags":null,"hasEmail":false}
+`
+	for _, parallel := range []bool{false, true} {
+		got := transformRaw(t, in, transform.FormatNDJSON, transform.FormatNDJSON, parallel)
+		if got != expected {
+			t.Errorf("parallel=%v unexpected output\nGot:\n%s\nWant:\n%s", parallel, got, expected)
+		}
+	}
+}
+
+func TestTransform_JSONOptionalKeys(t *testing.T) {
+	in := `{"name":"Alice"}
+{"name":"Bob","email":"bob@example.com"}
+`
+	expected := `name,email,hasEmail
+Alice,,false
+Bob,bob@example.com,true
+`
+	for _, parallel := range []bool{false, true} {
+		got := transformFormats(t, in, transform.FormatNDJSON, transform.FormatCSV, parallel)
+		if got != expected {
+			t.Errorf("parallel=%v unexpected output\nGot:\n%s\nWant:\n%s", parallel, got, expected)
+		}
+	}
+}
+
+func TestTransform_JSONExistingHasEmail(t *testing.T) {
+	in := `[{"email":"alice@example.com","hasEmail":false},{"email":"bob","hasEmail":"yes"}]`
+	expected := `[{"email":"alice@example.com","hasEmail":true},{"email":"bob","hasEmail":false}]
+`
+	got := transformRaw(t, in, transform.FormatJSON, transform.FormatJSON, false)
+	if got != expected {
+		t.Errorf("unexpected output\nGot:\n%s\nWant:\n%s", got, expected)
+	}
+}
+
+// Input that cannot seek takes its columns from the first object
+func TestTransform_JSONUnknownField(t *testing.T) {
+	in := `{"name":"Alice"}
+{"name":"Bob","email":"bob@example.com"}
+`
+	rr, _ := transform.NewReader(transform.FormatNDJSON, struct{ io.Reader }{strings.NewReader(in)})
+	var out bytes.Buffer
+	err := transform.TransformSequentialRecords(rr, transform.NewCSVWriter(&out))
+	if err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Fatalf("expected unknown field error, got %v", err)
+	}
+}
+
+func TestTransform_EmptyJSONArray(t *testing.T) {
+	rr, _ := transform.NewReader(transform.FormatJSON, strings.NewReader("[]"))
+	var out bytes.Buffer
+	err := transform.TransformSequentialRecords(rr, transform.NewCSVWriter(&out))
+	if err == nil || !strings.Contains(err.Error(), "empty or invalid") {
+		t.Fatalf("expected empty input error, got %v", err)
+	}
+}
+
+func TestFormatFromAccept(t *testing.T) {
+	cases := map[string]transform.Format{
+		"application/x-ndjson":                transform.FormatNDJSON,
+		"text/html, application/json;q=0.9":   transform.FormatJSON,
+		"text/csv":                            transform.FormatCSV,
+		"application/jsonl, application/json": transform.FormatNDJSON,
+	}
+	for accept, want := range cases {
+		got, ok := transform.FormatFromAccept(accept)
+		if !ok || got != want {
+			t.Errorf("FormatFromAccept(%q) = %q, %v; want %q", accept, got, ok, want)
+		}
+	}
+	if _, ok := transform.FormatFromAccept("*/*"); ok {
+		t.Error("expected wildcard to carry no preference")
+	}
+}
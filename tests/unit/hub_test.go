@@ -0,0 +1,43 @@
+package unit
+
+import (
+	"testing"
+
+	"csv-email-flagger/internal/jobs"
+)
+
+func TestHub_SlowSubscriberDoesNotBlock(t *testing.T) {
+	hub := jobs.NewHub()
+	slow := hub.Subscribe(nil, 1)
+	other := hub.Subscribe(func(e jobs.Event) bool { return e.JobID == "b" }, 10)
+	defer hub.Unsubscribe(slow)
+	defer hub.Unsubscribe(other)
+
+	// Nobody reads from slow, so all but its first event are dropped
+	for i := 0; i < 5; i++ {
+		hub.Publish(jobs.Event{JobID: "a", Type: jobs.EventProgress})
+	}
+	hub.Publish(jobs.Event{JobID: "b", Type: jobs.EventStatus, Status: jobs.StatusDone})
+
+	if e := <-slow.C; e.Seq != 1 {
+		t.Errorf("expected the first event, got seq %d", e.Seq)
+	}
+	if !slow.Lagged() {
+		t.Error("expected the slow subscriber to be marked as lagged")
+	}
+	if slow.Lagged() {
+		t.Error("Lagged should reset once reported")
+	}
+
+	select {
+	case e := <-other.C:
+		if e.JobID != "b" || e.Seq != 6 {
+			t.Errorf("unexpected filtered event %+v", e)
+		}
+	default:
+		t.Fatal("filtered subscriber did not receive its event")
+	}
+	if other.Lagged() {
+		t.Error("filtered subscriber should not lag")
+	}
+}
@@ -0,0 +1,113 @@
+package unit
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"csv-email-flagger/internal/transform"
+)
+
+var csvWithBareQuotes = `name,email
+Alice,alice@example.com
+Bob,bob"@example.com
+Charlie,charlie@test.com
+Dan,"dan"x@test.com
+`
+
+func runLenient(t *testing.T, in string, opts transform.Options, parallel bool) (string, error) {
+	t.Helper()
+	rr, err := transform.NewReader(transform.FormatCSV, strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("new reader: %v", err)
+	}
+	var out bytes.Buffer
+	rw := transform.NewCSVWriter(&out)
+	if parallel {
+		err = transform.TransformParallelWithOptions(rr, rw, 2, opts)
+	} else {
+		err = transform.TransformSequentialWithOptions(rr, rw, opts)
+	}
+	return out.String(), err
+}
+
+func TestTransform_LenientQuarantinesMalformedRows(t *testing.T) {
+	expected := `name,email,hasEmail
+Alice,alice@example.com,true
+Charlie,charlie@test.com,true
+`
+	for _, parallel := range []bool{false, true} {
+		var qbuf bytes.Buffer
+		q := transform.NewQuarantine(&qbuf)
+		got, err := runLenient(t, csvWithBareQuotes, transform.Options{Lenient: true, Quarantine: q}, parallel)
+		if err != nil {
+			t.Fatalf("parallel=%v lenient transform failed: %v", parallel, err)
+		}
+		if got != expected {
+			t.Errorf("parallel=%v unexpected output\nGot:\n%s\nWant:\n%s", parallel, got, expected)
+		}
+		q.Close()
+		if q.Count() != 2 {
+			t.Errorf("parallel=%v expected 2 quarantined rows, got %d", parallel, q.Count())
+		}
+		quarantined := qbuf.String()
+		if !strings.HasPrefix(quarantined, "line,error,raw\n3,") {
+			t.Errorf("unexpected quarantine header or line number:\n%s", quarantined)
+		}
+		if !strings.Contains(quarantined, `"Bob,bob""@example.com"`) || !strings.Contains(quarantined, `"Dan,""dan""x@test.com"`) {
+			t.Errorf("quarantine should hold the raw rows verbatim:\n%s", quarantined)
+		}
+	}
+}
+
+func TestTransform_StrictModeFailsOnMalformedRow(t *testing.T) {
+	if _, err := runLenient(t, csvWithBareQuotes, transform.Options{}, false); err == nil {
+		t.Fatal("expected strict transform to fail")
+	}
+}
+
+func TestTransform_LenientMaxErrors(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		_, err := runLenient(t, csvWithBareQuotes, transform.Options{Lenient: true, MaxErrors: 1}, parallel)
+		if err == nil || !strings.Contains(err.Error(), "too many malformed rows") {
+			t.Errorf("parallel=%v expected max errors failure, got %v", parallel, err)
+		}
+	}
+	if _, err := runLenient(t, csvWithBareQuotes, transform.Options{Lenient: true, MaxErrors: 2}, false); err != nil {
+		t.Errorf("expected two malformed rows to be tolerated, got %v", err)
+	}
+}
+
+func TestTransform_LenientMaxErrorRatio(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		_, err := runLenient(t, csvWithBareQuotes, transform.Options{Lenient: true, MaxErrorRatio: 0.25}, parallel)
+		if err == nil || !strings.Contains(err.Error(), "ratio") {
+			t.Errorf("parallel=%v expected ratio failure, got %v", parallel, err)
+		}
+	}
+	if _, err := runLenient(t, csvWithBareQuotes, transform.Options{Lenient: true, MaxErrorRatio: 0.5}, true); err != nil {
+		t.Errorf("expected 50%% malformed rows to be tolerated, got %v", err)
+	}
+}
+
+func TestTransform_LenientNDJSONUnknownField(t *testing.T) {
+	in := `{"name":"Alice","email":"alice@example.com"}
+{"name":"Bob","phone":"555"}
+{"name":"Carol","email":"carol@test.com"}
+`
+	rr, _ := transform.NewReader(transform.FormatNDJSON, struct{ io.Reader }{strings.NewReader(in)})
+	var out, qbuf bytes.Buffer
+	q := transform.NewQuarantine(&qbuf)
+	err := transform.TransformSequentialWithOptions(rr, transform.NewCSVWriter(&out), transform.Options{Lenient: true, Quarantine: q})
+	if err != nil {
+		t.Fatalf("lenient transform failed: %v", err)
+	}
+	q.Close()
+	if !strings.Contains(qbuf.String(), `2,`) || !strings.Contains(qbuf.String(), `"{""name"":""Bob"",""phone"":""555""}"`) {
+		t.Errorf("unexpected quarantine output:\n%s", qbuf.String())
+	}
+	if !strings.Contains(out.String(), "Carol,carol@test.com,true") {
+		t.Errorf("expected rows after the malformed one to be processed:\n%s", out.String())
+	}
+}
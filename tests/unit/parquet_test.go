@@ -0,0 +1,78 @@
+package unit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"csv-email-flagger/internal/transform"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestTransform_ParquetOutput(t *testing.T) {
+	csvIn := `name,email
+Alice,alice@example.com
+Bob,not-an-email
+Carol,carol@test.org
+`
+	var out bytes.Buffer
+	rw := transform.NewParquetWriter(&out, 2)
+	if err := transform.TransformSequentialRecords(transform.NewCSVReader(strings.NewReader(csvIn)), rw); err != nil {
+		t.Fatalf("transform failed: %v", err)
+	}
+
+	f, err := parquet.OpenFile(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("failed to open parquet output: %v", err)
+	}
+	if n := f.NumRows(); n != 3 {
+		t.Fatalf("expected 3 rows, got %d", n)
+	}
+	if n := len(f.RowGroups()); n != 2 {
+		t.Errorf("expected 2 row groups, got %d", n)
+	}
+
+	var columns []string
+	for _, field := range f.Schema().Fields() {
+		columns = append(columns, field.Name())
+	}
+	if got := strings.Join(columns, ","); got != "name,email,hasEmail" {
+		t.Errorf("expected columns in header order, got %s", got)
+	}
+
+	flag, ok := f.Schema().Lookup(transform.HasEmailHeader)
+	if !ok {
+		t.Fatal("hasEmail column missing")
+	}
+	if kind := flag.Node.Type().Kind(); kind != parquet.Boolean {
+		t.Errorf("expected boolean hasEmail column, got %v", kind)
+	}
+	email, ok := f.Schema().Lookup("email")
+	if !ok {
+		t.Fatal("email column missing")
+	}
+	if kind := email.Node.Type().Kind(); kind != parquet.ByteArray {
+		t.Errorf("expected string email column, got %v", kind)
+	}
+
+	type row struct {
+		Name     string `parquet:"name"`
+		Email    string `parquet:"email"`
+		HasEmail bool   `parquet:"hasEmail"`
+	}
+	rows, err := parquet.Read[row](bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("failed to read rows: %v", err)
+	}
+	want := []row{
+		{"Alice", "alice@example.com", true},
+		{"Bob", "not-an-email", false},
+		{"Carol", "carol@test.org", true},
+	}
+	for i := range want {
+		if rows[i] != want[i] {
+			t.Errorf("row %d: got %+v, want %+v", i, rows[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package unit
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"csv-email-flagger/internal/transform"
+)
+
+func TestTransform_ReportsProgress(t *testing.T) {
+	const rows = 10000
+	var b strings.Builder
+	b.WriteString("id,email\n")
+	for i := 1; i <= rows; i++ {
+		fmt.Fprintf(&b, "%d,user%d@example.com\n", i, i)
+	}
+	input := b.String()
+
+	runs := map[string]func(opts transform.Options) error{
+		"sequential": func(opts transform.Options) error {
+			rr, _ := transform.NewReader(transform.FormatCSV, strings.NewReader(input))
+			return transform.TransformSequentialWithOptions(rr, transform.NewCSVWriter(&bytes.Buffer{}), opts)
+		},
+		"parallel": func(opts transform.Options) error {
+			rr, _ := transform.NewReader(transform.FormatCSV, strings.NewReader(input))
+			return transform.TransformParallelWithOptions(rr, transform.NewCSVWriter(&bytes.Buffer{}), 4, opts)
+		},
+		"chunked": func(opts transform.Options) error {
+			opts.ChunkSize = 16 << 10
+			return transform.TransformChunked(strings.NewReader(input), transform.NewCSVWriter(&bytes.Buffer{}), 4, opts)
+		},
+	}
+	for name, run := range runs {
+		var reports []transform.Progress
+		opts := transform.Options{Progress: func(p transform.Progress) { reports = append(reports, p) }}
+		if err := run(opts); err != nil {
+			t.Fatalf("%s: transform failed: %v", name, err)
+		}
+		if len(reports) < 3 {
+			t.Fatalf("%s: expected periodic reports, got %d", name, len(reports))
+		}
+		for i := 1; i < len(reports); i++ {
+			if reports[i].Rows < reports[i-1].Rows || reports[i].BytesRead < reports[i-1].BytesRead {
+				t.Errorf("%s: progress went backwards: %+v then %+v", name, reports[i-1], reports[i])
+			}
+		}
+		last := reports[len(reports)-1]
+		if !last.Done || last.Rows != rows || last.BytesRead != int64(len(input)) {
+			t.Errorf("%s: unexpected final report %+v", name, last)
+		}
+		for _, p := range reports[:len(reports)-1] {
+			if p.Done || p.BytesRead <= 0 || p.BytesRead > int64(len(input)) {
+				t.Errorf("%s: unexpected intermediate report %+v", name, p)
+			}
+		}
+	}
+}
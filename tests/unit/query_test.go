@@ -0,0 +1,85 @@
+package unit
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"csv-email-flagger/internal/jobs"
+)
+
+func TestMemoryStore_Query(t *testing.T) {
+	store := jobs.NewMemoryStore(jobs.NewHub())
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	modes := []string{"sequential", "parallel", "chunked"}
+	for i := range 30 {
+		j := &jobs.Job{ID: fmt.Sprintf("job-%02d", i), Status: jobs.StatusQueued, Mode: modes[i%3], CreatedAt: base.Add(time.Duration(i) * time.Minute)}
+		if i%2 == 0 {
+			j.Tags = []string{"even"}
+		}
+		if i%10 == 3 {
+			j.Labels = map[string]string{"region": "eu"}
+		}
+		store.Create(j)
+	}
+	// Two jobs created at the same time are ordered by ID
+	store.Create(&jobs.Job{ID: "job-10b", Status: jobs.StatusQueued, Mode: "parallel", CreatedAt: base.Add(10 * time.Minute)})
+	for i := range 5 {
+		id := fmt.Sprintf("job-%02d", i*5)
+		store.Start(id)
+		store.SetStatus(id, jobs.StatusDone, nil)
+	}
+
+	// all pages through every match of q
+	all := func(q jobs.JobQuery) []string {
+		var ids []string
+		for {
+			page, err := store.Query(q)
+			if err != nil {
+				t.Fatalf("query %+v failed: %v", q, err)
+			}
+			if len(page.Jobs) > q.Limit {
+				t.Fatalf("page of %d jobs exceeds limit %d", len(page.Jobs), q.Limit)
+			}
+			for _, j := range page.Jobs {
+				ids = append(ids, j.ID)
+			}
+			if page.NextCursor == "" {
+				return ids
+			}
+			q.Cursor = page.NextCursor
+		}
+	}
+
+	cases := []struct {
+		name string
+		q    jobs.JobQuery
+		want []string
+	}{
+		{"newest first", jobs.JobQuery{Limit: 4, CreatedAfter: base.Add(8 * time.Minute), CreatedBefore: base.Add(11 * time.Minute)},
+			[]string{"job-11", "job-10b", "job-10", "job-09", "job-08"}},
+		{"oldest first", jobs.JobQuery{Limit: 2, Ascending: true, CreatedAfter: base.Add(9 * time.Minute), CreatedBefore: base.Add(11 * time.Minute)},
+			[]string{"job-09", "job-10", "job-10b", "job-11"}},
+		{"status", jobs.JobQuery{Limit: 2, Statuses: []jobs.JobStatus{jobs.StatusDone}},
+			[]string{"job-20", "job-15", "job-10", "job-05", "job-00"}},
+		{"status and tag", jobs.JobQuery{Limit: 10, Statuses: []jobs.JobStatus{jobs.StatusDone}, Tags: []string{"even"}},
+			[]string{"job-20", "job-10", "job-00"}},
+		{"mode and tag", jobs.JobQuery{Limit: 3, Ascending: true, Mode: "chunked", Tags: []string{"even"}},
+			[]string{"job-02", "job-08", "job-14", "job-20", "job-26"}},
+		{"label and tag", jobs.JobQuery{Limit: 1, Labels: map[string]string{"region": "eu"}, Tags: []string{"even"}}, nil},
+		{"label", jobs.JobQuery{Limit: 1, Labels: map[string]string{"region": "eu"}},
+			[]string{"job-23", "job-13", "job-03"}},
+		{"unknown tag", jobs.JobQuery{Limit: 3, Tags: []string{"odd"}}, nil},
+	}
+	for _, c := range cases {
+		if got := all(c.q); !slices.Equal(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	if _, err := store.Query(jobs.JobQuery{Cursor: "not a cursor"}); !errors.Is(err, jobs.ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+}
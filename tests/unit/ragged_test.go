@@ -0,0 +1,110 @@
+package unit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"csv-email-flagger/internal/transform"
+)
+
+var raggedCSV = `name,email,city
+Alice,alice@example.com
+Bob,bob@example.com,Paris,extra
+Carol,carol@test.com,Rome
+`
+
+func runRagged(t *testing.T, opts transform.Options, parallel bool) string {
+	t.Helper()
+	rr, _ := transform.NewReader(transform.FormatCSV, strings.NewReader(raggedCSV))
+	var out bytes.Buffer
+	var err error
+	if parallel {
+		err = transform.TransformParallelWithOptions(rr, transform.NewCSVWriter(&out), 2, opts)
+	} else {
+		err = transform.TransformSequentialWithOptions(rr, transform.NewCSVWriter(&out), opts)
+	}
+	if err != nil {
+		t.Fatalf("transform failed: %v", err)
+	}
+	return out.String()
+}
+
+func TestTransform_RaggedPadAndTruncate(t *testing.T) {
+	expected := `name,email,city,hasEmail
+Alice,alice@example.com,,true
+Bob,bob@example.com,Paris,true
+Carol,carol@test.com,Rome,true
+`
+	for _, parallel := range []bool{false, true} {
+		stats := &transform.Stats{}
+		opts := transform.Options{PadShortRows: true, LongRows: transform.LongRowsTruncate, Stats: stats}
+		if got := runRagged(t, opts, parallel); got != expected {
+			t.Errorf("parallel=%v unexpected output\nGot:\n%s\nWant:\n%s", parallel, got, expected)
+		}
+		if stats.PaddedRows != 1 || stats.TruncatedRows != 1 || stats.RejectedRows != 0 {
+			t.Errorf("parallel=%v unexpected stats %+v", parallel, *stats)
+		}
+	}
+}
+
+func TestTransform_RaggedReject(t *testing.T) {
+	expected := `name,email,city,hasEmail
+Alice,alice@example.com,true
+Carol,carol@test.com,Rome,true
+`
+	for _, parallel := range []bool{false, true} {
+		stats := &transform.Stats{}
+		opts := transform.Options{LongRows: transform.LongRowsReject, Stats: stats}
+		if got := runRagged(t, opts, parallel); got != expected {
+			t.Errorf("parallel=%v unexpected output\nGot:\n%s\nWant:\n%s", parallel, got, expected)
+		}
+		if stats.RejectedRows != 1 || stats.PaddedRows != 0 {
+			t.Errorf("parallel=%v unexpected stats %+v", parallel, *stats)
+		}
+	}
+}
+
+func TestTransform_RaggedRejectQuarantined(t *testing.T) {
+	expected := `line,error,raw
+3,"row has 4 fields, more than the 3 of the header","Bob,bob@example.com,Paris,extra"
+`
+	for _, parallel := range []bool{false, true} {
+		var qbuf bytes.Buffer
+		q := transform.NewQuarantine(&qbuf)
+		stats := &transform.Stats{}
+		runRagged(t, transform.Options{LongRows: transform.LongRowsReject, Quarantine: q, Stats: stats}, parallel)
+		q.Close()
+		if qbuf.String() != expected {
+			t.Errorf("parallel=%v unexpected quarantine output\nGot:\n%s\nWant:\n%s", parallel, qbuf.String(), expected)
+		}
+		if q.Count() != 1 || stats.MalformedRows != 1 {
+			t.Errorf("parallel=%v expected one malformed row, got %d quarantined and stats %+v", parallel, q.Count(), *stats)
+		}
+	}
+}
+
+func TestTransform_RaggedRejectErrorBudget(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		rr, _ := transform.NewReader(transform.FormatCSV, strings.NewReader(raggedCSV))
+		opts := transform.Options{LongRows: transform.LongRowsReject, MaxErrorRatio: 0.2}
+		var err error
+		if parallel {
+			err = transform.TransformParallelWithOptions(rr, transform.NewCSVWriter(&bytes.Buffer{}), 2, opts)
+		} else {
+			err = transform.TransformSequentialWithOptions(rr, transform.NewCSVWriter(&bytes.Buffer{}), opts)
+		}
+		if err == nil || !strings.Contains(err.Error(), "ratio") {
+			t.Errorf("parallel=%v expected ratio failure, got %v", parallel, err)
+		}
+	}
+}
+
+func TestParseLongRowPolicy(t *testing.T) {
+	if p, err := transform.ParseLongRowPolicy("Truncate"); err != nil || p != transform.LongRowsTruncate {
+		t.Errorf("expected truncate policy, got %q, %v", p, err)
+	}
+	if _, err := transform.ParseLongRowPolicy("explode"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
@@ -0,0 +1,32 @@
+package unit
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io/fs"
+	"syscall"
+	"testing"
+
+	"csv-email-flagger/internal/jobs"
+)
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"disk full", &fs.PathError{Op: "write", Path: "out.csv", Err: syscall.ENOSPC}, true},
+		{"io error", fmt.Errorf("read input: %w", &fs.PathError{Op: "read", Path: "in.csv", Err: syscall.EIO}), true},
+		{"too many open files", &fs.PathError{Op: "open", Path: "in.csv", Err: syscall.EMFILE}, true},
+		{"missing upload", &fs.PathError{Op: "open", Path: "in.csv", Err: syscall.ENOENT}, false},
+		{"malformed csv", &csv.ParseError{Line: 2, Err: csv.ErrQuote}, false},
+		{"timeout", context.DeadlineExceeded, false},
+	}
+	for _, c := range cases {
+		if got := jobs.Retryable(c.err); got != c.want {
+			t.Errorf("%s: Retryable = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package unit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"csv-email-flagger/internal/transform"
+)
+
+var statsCSV = `name,email,alt
+Alice,alice@example.com,ALICE@example.com
+  , ,
+Bob,bob@test.org,
+Carol,carol@example.com,
+Dan,not-an-email,
+Eve,"eve"@x.com,
+`
+
+func TestTransform_Stats(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		rr, _ := transform.NewReader(transform.FormatCSV, strings.NewReader(statsCSV))
+		var out bytes.Buffer
+		stats := &transform.Stats{}
+		opts := transform.Options{Lenient: true, Stats: stats}
+		var err error
+		if parallel {
+			err = transform.TransformParallelWithOptions(rr, transform.NewCSVWriter(&out), 3, opts)
+		} else {
+			err = transform.TransformSequentialWithOptions(rr, transform.NewCSVWriter(&out), opts)
+		}
+		if err != nil {
+			t.Fatalf("parallel=%v transform failed: %v", parallel, err)
+		}
+
+		if stats.RowsRead != 5 || stats.RowsWritten != 4 || stats.BlankRowsSkipped != 1 {
+			t.Errorf("parallel=%v unexpected row counts %+v", parallel, *stats)
+		}
+		if stats.RowsWithEmail != 3 || stats.MalformedRows != 1 {
+			t.Errorf("parallel=%v unexpected email/malformed counts %+v", parallel, *stats)
+		}
+		if stats.DistinctAddresses != 3 {
+			t.Errorf("parallel=%v expected 3 distinct addresses, got %d", parallel, stats.DistinctAddresses)
+		}
+		want := []transform.DomainCount{{Domain: "example.com", Count: 3}, {Domain: "test.org", Count: 1}}
+		if len(stats.TopDomains) != len(want) {
+			t.Fatalf("parallel=%v unexpected top domains %+v", parallel, stats.TopDomains)
+		}
+		for i := range want {
+			if stats.TopDomains[i] != want[i] {
+				t.Errorf("parallel=%v top domain %d: got %+v, want %+v", parallel, i, stats.TopDomains[i], want[i])
+			}
+		}
+		if stats.Timings.Total <= 0 {
+			t.Errorf("parallel=%v expected total time to be recorded", parallel)
+		}
+	}
+}
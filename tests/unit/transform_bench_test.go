@@ -0,0 +1,240 @@
+package unit
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"csv-email-flagger/internal/transform"
+)
+
+// benchInputSize is the size of the generated input, 64 MB unless overridden
+// with CSV_BENCH_BYTES (1073741824 for the full 1 GB comparison)
+func benchInputSize(b *testing.B) int64 {
+	if v := os.Getenv("CSV_BENCH_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			b.Fatalf("invalid CSV_BENCH_BYTES %q", v)
+		}
+		return n
+	}
+	return 64 << 20
+}
+
+// csvGenerator streams size bytes of CSV by repeating a block of rows, so the
+// input is never held in memory and generating it costs next to nothing. One
+// row in four carries an email address.
+type csvGenerator struct {
+	remaining int64
+	block     []byte
+	pos       int
+	header    bool
+}
+
+var benchBlock = func() []byte {
+	var buf []byte
+	for row := 1; row <= 10000; row++ {
+		contact := fmt.Sprintf("+1-555-%04d", row)
+		if row%4 == 0 {
+			contact = fmt.Sprintf("user%d@example%d.com", row, row%50)
+		}
+		buf = fmt.Appendf(buf, "%d,Customer %d,%s,some free text about the customer\n", row, row, contact)
+	}
+	return buf
+}()
+
+func newCSVGenerator(size int64) *csvGenerator {
+	return &csvGenerator{remaining: size, block: benchBlock}
+}
+
+func (g *csvGenerator) Read(p []byte) (int, error) {
+	if g.remaining <= 0 {
+		return 0, io.EOF
+	}
+	var n int
+	if !g.header {
+		g.header = true
+		n = copy(p, "id,name,contact,notes\n")
+	} else {
+		n = copy(p, g.block[g.pos:])
+		g.pos = (g.pos + n) % len(g.block)
+	}
+	if int64(n) > g.remaining {
+		n = int(g.remaining)
+	}
+	g.remaining -= int64(n)
+	return n, nil
+}
+
+func runTransformBenchmark(b *testing.B, run func(in io.Reader, out io.Writer) error) {
+	size := benchInputSize(b)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := run(newCSVGenerator(size), io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTransformSequential(b *testing.B) {
+	runTransformBenchmark(b, transform.TransformSequential)
+}
+
+// BenchmarkTransformParallelPerRow runs the parallel transform as it was before
+// batching, as the baseline for BenchmarkTransformParallelBatched
+func BenchmarkTransformParallelPerRow(b *testing.B) {
+	runTransformBenchmark(b, func(in io.Reader, out io.Writer) error {
+		return transformParallelPerRow(in, out, 4)
+	})
+}
+
+func BenchmarkTransformParallelBatched(b *testing.B) {
+	runTransformBenchmark(b, func(in io.Reader, out io.Writer) error {
+		return transform.TransformParallel(in, out, 4)
+	})
+}
+
+// BenchmarkTransformChunked parses byte ranges of a stored file concurrently
+func BenchmarkTransformChunked(b *testing.B) {
+	size := benchInputSize(b)
+	path := filepath.Join(b.TempDir(), "bench.csv")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := io.Copy(f, newCSVGenerator(size)); err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		in, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = transform.TransformChunked(in, transform.NewCSVWriter(io.Discard), 4, transform.Options{})
+		in.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type perRowResult struct {
+	index int
+	data  []string
+	skip  bool
+}
+
+// transformParallelPerRow is the parallel transform before batching, without
+// its options: every row is a channel message on its way to a worker and back,
+// a new record is allocated per row and every row goes through the regex.
+func transformParallelPerRow(in io.Reader, out io.Writer, workerCount int) error {
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = -1
+	cw := csv.NewWriter(out)
+
+	const window = 1024
+	slots := make(chan struct{}, window)
+	done := make(chan struct{})
+	defer close(done)
+
+	type row struct {
+		index int
+		data  []string
+	}
+	rowChan := make(chan row, workerCount)
+	resChan := make(chan perRowResult, window+1)
+	readErr := make(chan error, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rowChan {
+				if r.index == 0 {
+					resChan <- perRowResult{index: 0, data: append(r.data, transform.HasEmailHeader)}
+					continue
+				}
+				isEmpty := true
+				for _, field := range r.data {
+					if strings.TrimSpace(field) != "" {
+						isEmpty = false
+						break
+					}
+				}
+				if isEmpty {
+					resChan <- perRowResult{index: r.index, skip: true}
+					continue
+				}
+				hasEmail := transform.IsValidEmail(strings.Join(r.data, " "))
+				resChan <- perRowResult{index: r.index, data: append(r.data, fmt.Sprintf("%t", hasEmail))}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(resChan)
+	}()
+
+	go func() {
+		defer close(rowChan)
+		for idx := 0; ; idx++ {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case rowChan <- row{index: idx, data: rec}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	pending := make([]perRowResult, window)
+	ready := make([]bool, window)
+	next := 0
+	for res := range resChan {
+		pending[res.index%window] = res
+		ready[res.index%window] = true
+		for ready[next%window] {
+			r := pending[next%window]
+			pending[next%window] = perRowResult{}
+			ready[next%window] = false
+			if !r.skip {
+				if err := cw.Write(r.data); err != nil {
+					return err
+				}
+			}
+			next++
+			<-slots
+		}
+	}
+	select {
+	case err := <-readErr:
+		return err
+	default:
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,80 @@
+package unit
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"csv-email-flagger/internal/transform"
+)
+
+// countingWriter counts records as they are written, header included
+type countingWriter struct {
+	transform.RecordWriter
+	written atomic.Int64
+}
+
+func (w *countingWriter) Write(rec []string) error {
+	err := w.RecordWriter.Write(rec)
+	w.written.Add(1)
+	return err
+}
+
+func TestTransformParallel_BoundedWindowWithSkewedLatency(t *testing.T) {
+	const (
+		rows    = 2000
+		window  = 16
+		workers = 4
+	)
+	var in, expected strings.Builder
+	in.WriteString("id,email\n")
+	expected.WriteString("id,email,hasEmail\n")
+	for i := 1; i <= rows; i++ {
+		fmt.Fprintf(&in, "%d,user%d@example.com\n", i, i)
+		fmt.Fprintf(&expected, "%d,user%d@example.com,true\n", i, i)
+	}
+
+	var out bytes.Buffer
+	cw := &countingWriter{RecordWriter: transform.NewCSVWriter(&out)}
+	var maxInFlight, violations atomic.Int64
+	opts := transform.Options{
+		Window: window,
+		Detector: func(rec []string, _ bool) (bool, []string) {
+			// Row indexes count the header as 0, so data row i has index i
+			i, _ := strconv.Atoi(rec[0])
+			inFlight := int64(i) - cw.written.Load() + 1
+			for {
+				cur := maxInFlight.Load()
+				if inFlight <= cur || maxInFlight.CompareAndSwap(cur, inFlight) {
+					break
+				}
+			}
+			if inFlight > window {
+				violations.Add(1)
+			}
+			// Every 50th row is slow, the rest are instant
+			if i%50 == 1 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			return transform.IsValidEmail(strings.Join(rec, " ")), nil
+		},
+	}
+
+	rr := transform.NewCSVReader(strings.NewReader(in.String()))
+	if err := transform.TransformParallelWithOptions(rr, cw, workers, opts); err != nil {
+		t.Fatalf("parallel transform failed: %v", err)
+	}
+	if out.String() != expected.String() {
+		t.Fatal("output order does not match input order")
+	}
+	if n := violations.Load(); n > 0 {
+		t.Errorf("%d rows were dispatched beyond the window of %d (max in flight %d)", n, window, maxInFlight.Load())
+	}
+	if maxInFlight.Load() < window/2 {
+		t.Errorf("expected the window to fill behind slow rows, max in flight was %d", maxInFlight.Load())
+	}
+}